@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Signals making the daemon check the token right away, none outside of
+// unix.
+var checkSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals making the daemon check the token right away.
+var checkSignals = []os.Signal{syscall.SIGUSR1}
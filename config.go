@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Contents of the YAML file passed with --config-file. Every key mirrors a
+// flag and is only used when that flag isn't given on the command line.
+type Config struct {
+	VaultAddr           string    `yaml:"vaultAddr"`
+	MinTTL              string    `yaml:"minTTL"`
+	TokenPath           string    `yaml:"tokenPath"`
+	Interval            string    `yaml:"interval"`
+	Native              string    `yaml:"native"`
+	MountPath           string    `yaml:"mountPath"`
+	Role                string    `yaml:"role"`
+	Output              string    `yaml:"output"`
+	CACert              string    `yaml:"caCert"`
+	CAPath              string    `yaml:"caPath"`
+	TLSSkipVerify       string    `yaml:"tlsSkipVerify"`
+	Namespace           string    `yaml:"namespace"`
+	LoginTimeout        string    `yaml:"loginTimeout"`
+	LoginKillTimeout    string    `yaml:"loginKillTimeout"`
+	LogFormat           string    `yaml:"logFormat"`
+	Quiet               string    `yaml:"quiet"`
+	Verbose             string    `yaml:"verbose"`
+	CallbackPort        string    `yaml:"callbackPort"`
+	BrowserCmd          string    `yaml:"browserCmd"`
+	MaxRetries          string    `yaml:"maxRetries"`
+	RetryBaseDelay      string    `yaml:"retryBaseDelay"`
+	ClockSkewTolerance  string    `yaml:"clockSkewTolerance"`
+	Notify              string    `yaml:"notify"`
+	WebhookURL          string    `yaml:"webhookURL"`
+	WebhookTimeout      string    `yaml:"webhookTimeout"`
+	MetricsAddr         string    `yaml:"metricsAddr"`
+	DryRun              string    `yaml:"dryRun"`
+	UseTokenHelper      string    `yaml:"useTokenHelper"`
+	Headless            string    `yaml:"headless"`
+	Proxy               string    `yaml:"proxy"`
+	AbortOnLookupError  string    `yaml:"abortOnLookupError"`
+	PostLoginHook       string    `yaml:"postLoginHook"`
+	Jitter              string    `yaml:"jitter"`
+	Force               string    `yaml:"force"`
+	HealthCheck         string    `yaml:"healthCheck"`
+	RequirePolicy       listValue `yaml:"requirePolicy"`
+	LockFile            string    `yaml:"lockFile"`
+	TTLUnit             string    `yaml:"ttlUnit"`
+	BackgroundRenew     string    `yaml:"backgroundRenew"`
+	ClientCert          string    `yaml:"clientCert"`
+	ClientKey           string    `yaml:"clientKey"`
+	RequestTTL          string    `yaml:"requestTTL"`
+	Timeout             string    `yaml:"timeout"`
+	OIDCParam           listValue `yaml:"oidcParam"`
+	SOCKS5              string    `yaml:"socks5"`
+	TokenType           string    `yaml:"tokenType"`
+	PIDFile             string    `yaml:"pidFile"`
+	MinLoginInterval    string    `yaml:"minLoginInterval"`
+	RedirectURI         string    `yaml:"redirectURI"`
+	CallbackPortRange   string    `yaml:"callbackPortRange"`
+	HealthRetries       string    `yaml:"healthRetries"`
+	AuditLog            string    `yaml:"auditLog"`
+	KeepCallbackServer  string    `yaml:"keepCallbackServer"`
+	Method              string    `yaml:"method"`
+	LoginParam          listValue `yaml:"loginParam"`
+	CacheFile           string    `yaml:"cacheFile"`
+	Env                 listValue `yaml:"env"`
+	ShutdownGrace       string    `yaml:"shutdownGrace"`
+	SuccessMessage      string    `yaml:"successMessage"`
+	DumpLookup          string    `yaml:"dumpLookup"`
+	CallbackAddr        string    `yaml:"callbackAddr"`
+	AllowRemoteCallback string    `yaml:"allowRemoteCallback"`
+	RenewOnly           string    `yaml:"renewOnly"`
+	TokenFormat         string    `yaml:"tokenFormat"`
+	NumUses             string    `yaml:"numUses"`
+
+	Profiles map[string]Profile `yaml:"profiles"`
+	Tokens   []TokenEntry       `yaml:"tokens"`
+}
+
+// Value of a repeatable flag, given in the config file either in the comma
+// separated form of the flag, as a list or, for key=value flags, as a map.
+type listValue string
+
+func (v *listValue) UnmarshalYAML(node *yaml.Node) error {
+	var items []string
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if err := node.Decode(&items); err != nil {
+			return err
+		}
+	case yaml.MappingNode:
+		var m map[string]string
+		if err := node.Decode(&m); err != nil {
+			return err
+		}
+		for k, val := range m {
+			items = append(items, k+"="+val)
+		}
+		sort.Strings(items)
+	default:
+		var str string
+		if err := node.Decode(&str); err != nil {
+			return err
+		}
+		items = []string{str}
+	}
+	*v = listValue(strings.Join(items, ","))
+	return nil
+}
+
+// Settings of one Vault cluster, selected with --profile. They take
+// precedence over the top-level keys of the config file.
+type Profile struct {
+	VaultAddr string `yaml:"vaultAddr"`
+	TokenPath string `yaml:"tokenPath"`
+	Role      string `yaml:"role"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Token of the tokens list, checked along with the others of the list in a
+// single run. Keys missing from an entry fall back to the top-level ones.
+type TokenEntry struct {
+	VaultAddr string `yaml:"vaultAddr"`
+	TokenPath string `yaml:"tokenPath"`
+	Role      string `yaml:"role"`
+	MinTTL    string `yaml:"minTTL"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Reads and parses the YAML config file at path.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	if err := yaml.Unmarshal(configData, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing config file: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// Returns the config values keyed by the name of the flag they stand for.
+func (c Config) flagValues() map[string]string {
+	return map[string]string{
+		"vault-addr":            c.VaultAddr,
+		"min-ttl":               c.MinTTL,
+		"token-path":            c.TokenPath,
+		"interval":              c.Interval,
+		"native":                c.Native,
+		"mount-path":            c.MountPath,
+		"role":                  c.Role,
+		"output":                c.Output,
+		"ca-cert":               c.CACert,
+		"ca-path":               c.CAPath,
+		"tls-skip-verify":       c.TLSSkipVerify,
+		"namespace":             c.Namespace,
+		"login-timeout":         c.LoginTimeout,
+		"login-kill-timeout":    c.LoginKillTimeout,
+		"log-format":            c.LogFormat,
+		"quiet":                 c.Quiet,
+		"verbose":               c.Verbose,
+		"callback-port":         c.CallbackPort,
+		"browser-cmd":           c.BrowserCmd,
+		"max-retries":           c.MaxRetries,
+		"retry-base-delay":      c.RetryBaseDelay,
+		"clock-skew-tolerance":  c.ClockSkewTolerance,
+		"notify":                c.Notify,
+		"webhook-url":           c.WebhookURL,
+		"webhook-timeout":       c.WebhookTimeout,
+		"metrics-addr":          c.MetricsAddr,
+		"dry-run":               c.DryRun,
+		"use-token-helper":      c.UseTokenHelper,
+		"headless":              c.Headless,
+		"proxy":                 c.Proxy,
+		"abort-on-lookup-error": c.AbortOnLookupError,
+		"post-login-hook":       c.PostLoginHook,
+		"jitter":                c.Jitter,
+		"force":                 c.Force,
+		"health-check":          c.HealthCheck,
+		"require-policy":        string(c.RequirePolicy),
+		"lock-file":             c.LockFile,
+		"ttl-unit":              c.TTLUnit,
+		"background-renew":      c.BackgroundRenew,
+		"client-cert":           c.ClientCert,
+		"client-key":            c.ClientKey,
+		"request-ttl":           c.RequestTTL,
+		"timeout":               c.Timeout,
+		"oidc-param":            string(c.OIDCParam),
+		"socks5":                c.SOCKS5,
+		"token-type":            c.TokenType,
+		"pid-file":              c.PIDFile,
+		"min-login-interval":    c.MinLoginInterval,
+		"redirect-uri":          c.RedirectURI,
+		"callback-port-range":   c.CallbackPortRange,
+		"health-retries":        c.HealthRetries,
+		"audit-log":             c.AuditLog,
+		"keep-callback-server":  c.KeepCallbackServer,
+		"method":                c.Method,
+		"login-param":           string(c.LoginParam),
+		"cache-file":            c.CacheFile,
+		"env":                   string(c.Env),
+		"shutdown-grace":        c.ShutdownGrace,
+		"success-message":       c.SuccessMessage,
+		"dump-lookup":           c.DumpLookup,
+		"callback-addr":         c.CallbackAddr,
+		"allow-remote-callback": c.AllowRemoteCallback,
+		"renew-only":            c.RenewOnly,
+		"token-format":          c.TokenFormat,
+		"num-uses":              c.NumUses,
+	}
+}
+
+// Returns the name of the profile to use: the requested one, or the only
+// profile defined if none is requested. Returns "" if there are no profiles.
+func (c Config) selectProfile(requested string) (string, error) {
+	if requested != "" {
+		if _, ok := c.Profiles[requested]; !ok {
+			return "", fmt.Errorf("profile %q not found, available profiles: %s", requested, c.profileNames())
+		}
+		return requested, nil
+	}
+
+	switch len(c.Profiles) {
+	case 0:
+		return "", nil
+	case 1:
+		for name := range c.Profiles {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("--profile must be specified, available profiles: %s", c.profileNames())
+}
+
+// Returns the sorted, comma separated names of the profiles.
+func (c Config) profileNames() string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Returns the profile values keyed by the name of the flag they stand for.
+func (p Profile) flagValues() map[string]string {
+	return map[string]string{
+		"vault-addr": p.VaultAddr,
+		"token-path": p.TokenPath,
+		"role":       p.Role,
+		"namespace":  p.Namespace,
+	}
+}
+
+// Prefix of the environment variables mirroring the flags, e.g. VPOL_MIN_TTL
+// stands for --min-ttl.
+const envPrefix = "VPOL_"
+
+// Flags triggering actions rather than settings.
+var actionFlags = map[string]bool{
+	"version":                     true,
+	"status":                      true,
+	"check-only":                  true,
+	"print-token-path":            true,
+	"config-check":                true,
+	"revoke":                      true,
+	"print-token":                 true,
+	"i-understand-token-exposure": true,
+}
+
+// Returns the VPOL_ environment variables keyed by the name of the flag they
+// stand for. Flags triggering actions rather than settings are left out.
+func envFlagValues() map[string]string {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if actionFlags[f.Name] {
+			return
+		}
+		values[f.Name] = os.Getenv(envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_")))
+	})
+	return values
+}
+
+// Sets the flags in values that aren't set yet, marking them as set so that
+// lower precedence sources applied afterwards don't override them.
+func applyFlagValues(set map[string]bool, values map[string]string, source string) error {
+	for name, value := range values {
+		if value == "" || set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in %s: %v", value, name, source, err)
+		}
+		set[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Prints the value of every setting flag for --config-check, marking the
+// ones left to their default, then the tokens list of the config file.
+func printConfig(set map[string]bool, tokenEntries []TokenEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		if actionFlags[f.Name] {
+			return
+		}
+		source := ""
+		if !set[f.Name] {
+			source = "(default)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Name, redactFlagValue(f), source)
+	})
+	w.Flush()
+
+	for i, e := range tokenEntries {
+		fmt.Printf("tokens[%d]: vaultAddr=%s tokenPath=%s role=%s minTTL=%s namespace=%s\n", i, e.VaultAddr, e.TokenPath, e.Role, e.MinTTL, e.Namespace)
+	}
+}
+
+// Returns the value of f, with the credentials it may hold redacted.
+func redactFlagValue(f *flag.Flag) string {
+	value := f.Value.String()
+	switch f.Name {
+	case "login-param", "env":
+		// Values of key=value pairs, e.g. a jwt or a VAULT_TOKEN.
+		kv := *f.Value.(*keyValuesFlag)
+		pairs := make([]string, 0, len(kv))
+		for k := range kv {
+			pairs = append(pairs, k+"=[redacted]")
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case "webhook-url":
+		// Webhooks like Slack's carry their secret in the path.
+		if u, err := url.Parse(value); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host + "/[redacted]"
+		}
+	case "proxy", "socks5":
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+	}
+	return value
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Installs the default slog logger for the given -log-format. Text logs show
+// token TTLs in ttlUnit.
+func setupLogger(format string, level slog.Leveler, ttlUnit string) error {
+	var handler slog.Handler
+	switch format {
+	case logFormatText:
+		handler = &legacyHandler{level: level, out: log.New(os.Stderr, "", log.LstdFlags), ttlUnit: ttlUnit}
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	default:
+		return fmt.Errorf("--log-format must be either %s or %s", logFormatText, logFormatJSON)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Renders records as the `### message key=value` lines this tool has always
+// printed, so text logs stay readable and grep-able.
+type legacyHandler struct {
+	level  slog.Leveler
+	out    *log.Logger
+	attrs  []slog.Attr
+	prefix string
+
+	ttlUnit string
+}
+
+func (h *legacyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *legacyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString("### ")
+	b.WriteString(r.Message)
+
+	for _, a := range h.attrs {
+		h.appendAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&b, h.prefix, a)
+		return true
+	})
+
+	return h.out.Output(2, b.String())
+}
+
+func (h *legacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &h2
+}
+
+func (h *legacyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// Appends a ` key=value` pair to b, flattening groups into dotted keys.
+func (h *legacyHandler) appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			h.appendAttr(b, prefix, ga)
+		}
+		return
+	}
+
+	value := a.Value.String()
+	if prefix+a.Key == "ttl" && h.ttlUnit != ttlUnitGo {
+		if d, err := time.ParseDuration(value); err == nil {
+			value = formatTTL(d, h.ttlUnit)
+		}
+	}
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+
+	b.WriteString(" ")
+	b.WriteString(prefix + a.Key)
+	b.WriteString("=")
+	b.WriteString(value)
+}
@@ -1,162 +1,1185 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/giuscri/vault-periodic-oidc-login/tokenmgr"
 	"github.com/hashicorp/vault/api"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/net/http/httpproxy"
+	xproxy "golang.org/x/net/proxy"
 )
 
-type Config struct {
-	VaultAddr string `yaml:"vaultAddr"`
-	MinTTL    string `yaml:"minTTL"`
-	TokenPath string `yaml:"tokenPath"`
+// Build metadata, injected by goreleaser through -ldflags -X.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// Exit codes, documented in the -help output.
+const (
+	exitTokenValid  = 0
+	exitRefreshed   = 10
+	exitLoginFailed = 20
+	exitConfigError = 30
+	exitNeedsLogin  = 40
+	exitHookFailed  = 50
+	exitTimeout     = 60
+	exitShutdown    = 70
+)
+
+const exitCodesUsage = `
+Exit codes:
+  0   token is still valid, nothing was done, or --revoke succeeded
+  10  token was renewed or a re-login was performed successfully
+  20  login or --revoke failed, or --health-check found the vault server unusable
+  30  configuration error
+  40  --dry-run, --status or --check-only only: the token needs to be refreshed
+  50  login succeeded but --post-login-hook failed
+  60  --timeout was reached
+  70  daemon shutdown cancelled a check in progress, after --shutdown-grace
+`
+
+// Settings of the CLI itself, the ones about the token are in tokenmgr.Config.
+type options struct {
+	tokenPath string
+	output    string
+	ttlUnit   string
+
+	// Keep the token renewed between the checks of the daemon.
+	backgroundRenew bool
+
+	metricsAddr string
+
+	pidFile string
+
+	// File every check is appended to as a JSON line.
+	auditLog string
+
+	// Time given to a check in progress to finish once the daemon is told
+	// to stop.
+	shutdownGrace time.Duration
 }
 
 func main() {
-	var configFile string
-	flag.StringVar(&configFile, "config-file", "", "Path to configuration YAML file")
+	var configFile, profile string
+	var vaultAddr, minTTLStr, unexpandedTokenPath string
+	var interval, jitter time.Duration
+	var shutdownGrace time.Duration
+	var native bool
+	var method string
+	var loginParams keyValuesFlag
+	var mountPath string
+	var role string
+	var output string
+	var caCert, caPath string
+	var clientCert, clientKey string
+	var tlsSkipVerify bool
+	var namespace string
+	var loginTimeout, loginKillTimeout time.Duration
+	var logFormat string
+	var quiet, verbose bool
+	var printVersion bool
+	var callbackPort int
+	var callbackAddr string
+	var allowRemoteCallback bool
+	var browserCmd string
+	var maxRetries int
+	var retryBaseDelay time.Duration
+	var clockSkewTolerance time.Duration
+	var notify bool
+	var webhookURL string
+	var webhookTimeout time.Duration
+	var metricsAddr string
+	var dryRun bool
+	var useTokenHelper bool
+	var headless bool
+	var printStatus bool
+	var checkOnly bool
+	var printTokenPath bool
+	var configCheck bool
+	var revoke bool
+	var printToken, tokenExposureAck bool
+	var proxy string
+	var socks5 string
+	var abortOnLookupError bool
+	var postLoginHook string
+	var force bool
+	var renewOnly bool
+	var healthCheck bool
+	var healthRetries int
+	var auditLog string
+	var cacheFile string
+	var loginEnv keyValuesFlag
+	var successMessage string
+	var requirePolicies stringsFlag
+	var lockFile string
+	var ttlUnit string
+	var backgroundRenew bool
+	var requestTTL time.Duration
+	var timeout time.Duration
+	var oidcParams keyValuesFlag
+	var tokenType string
+	var numUses int
+	var pidFile string
+	var minLoginInterval time.Duration
+	var redirectURI string
+	var callbackPortRange string
+	var keepCallbackServer bool
+	var dumpLookup bool
+	var tokenFormat string
+	flag.StringVar(&configFile, "config-file", "", "Path to configuration YAML file, its keys mirror the flags in camelCase")
+	flag.StringVar(&configFile, "config", "", "Alias for --config-file")
+	flag.StringVar(&profile, "profile", "", "Name of the profile to use from the config file")
+	flag.StringVar(&vaultAddr, "vault-addr", "", "Address of the Vault server, or comma separated addresses tried in order until one answers (defaults to VAULT_ADDR)")
+	flag.StringVar(&minTTLStr, "min-ttl", "", "Login again when the token TTL drops below this duration, or below this percentage of its creation TTL, e.g. 25%")
+	flag.StringVar(&unexpandedTokenPath, "token-path", "$HOME/.vault-token", "Path to the token file, environment variables, ~/, {{.Host}} (of --vault-addr) and {{.Profile}} are expanded")
+	flag.DurationVar(&interval, "interval", 0, "Check the token periodically at this interval (0 runs once and exits)")
+	flag.StringVar(&cacheFile, "cache-file", "", "File caching the token expiry, so that runs skip contacting Vault while the token file is unchanged and far from expiring")
+	flag.StringVar(&successMessage, "success-message", "", "Go template of the line logged after a successful login, e.g. 'token valid for {{.TTL}}', with {{.TTL}}, {{.TTLSeconds}}, {{.Accessor}}, {{.VaultAddr}}, {{.TokenPath}} and {{.Role}}")
+	flag.StringVar(&auditLog, "audit-log", "", "File to append a JSON line to for every check, with its time, vault address, action, TTL and token accessor")
+	flag.StringVar(&pidFile, "pid-file", "", "In daemon mode, write the PID to this file and remove it on exit, refusing to start if it belongs to a running process")
+	flag.DurationVar(&minLoginInterval, "min-login-interval", 5*time.Minute, "In daemon mode, wait at least this long after a login before logging in again, e.g. when the role issues tokens below --min-ttl (0 disables)")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 0, "In daemon mode, on SIGINT, SIGTERM or SIGHUP let a check in progress finish for up to this duration before cancelling it")
+	flag.DurationVar(&jitter, "jitter", 0, "Add a random delay of up to this duration to each --interval, to spread the load on Vault")
+	flag.BoolVar(&native, "native", false, "Login through the Vault API instead of the vault CLI")
+	flag.StringVar(&method, "method", tokenmgr.MethodOIDC, "Auth method to login with, either oidc, jwt or github, the latter two reading their credential from --login-param")
+	flag.Var(&loginEnv, "env", "Extra KEY=VALUE environment variable of the vault login process, e.g. VAULT_CLIENT_TIMEOUT=120s (repeatable, or comma separated)")
+	flag.Var(&loginParams, "login-param", "Extra key=value parameter of the login, e.g. jwt=<token> with --method jwt or token=<token> with --method github (repeatable, or comma separated)")
+	flag.StringVar(&mountPath, "mount-path", "", "Path where the auth method is mounted (defaults to --method)")
+	flag.StringVar(&role, "role", "", "OIDC role to login with (defaults to the auth method's default_role), or a comma separated list of roles to try in turn until a login works")
+	flag.StringVar(&output, "output", outputText, "Output format, either text or json")
+	flag.StringVar(&caCert, "ca-cert", "", "Path to a PEM-encoded CA certificate to verify the Vault server")
+	flag.StringVar(&caPath, "ca-path", "", "Path to a directory of PEM-encoded CA certificates to verify the Vault server")
+	flag.StringVar(&clientCert, "client-cert", "", "Path to a PEM-encoded client certificate presented to the Vault server, requires --client-key")
+	flag.StringVar(&clientKey, "client-key", "", "Path to the PEM-encoded private key of --client-cert")
+	flag.BoolVar(&tlsSkipVerify, "tls-skip-verify", false, "Skip verification of the Vault server certificate (insecure, dev only)")
+	flag.StringVar(&namespace, "namespace", "", "Vault Enterprise namespace (defaults to VAULT_NAMESPACE)")
+	flag.DurationVar(&loginTimeout, "login-timeout", 1*time.Minute, "Time to complete the login before sending SIGTERM to vault login")
+	flag.DurationVar(&loginKillTimeout, "login-kill-timeout", 90*time.Second, "Time to complete the login before sending SIGKILL to vault login")
+	flag.StringVar(&logFormat, "log-format", logFormatText, "Log format, either text or json")
+	flag.BoolVar(&quiet, "quiet", false, "Only log errors")
+	flag.BoolVar(&verbose, "verbose", false, "Log debug details")
+	flag.BoolVar(&printVersion, "version", false, "Print version information and exit")
+	flag.BoolVar(&checkOnly, "check-only", false, "Exit 0 if the token TTL is above --min-ttl and 40 otherwise, silently unless --verbose and without renewing or logging in")
+	flag.BoolVar(&printStatus, "status", false, "Print the TTL of the current token and exit, without renewing or logging in")
+	flag.BoolVar(&printToken, "print-token", false, "Print the token to stdout once it's valid, logging in if needed, e.g. for VAULT_TOKEN=$(...) (requires --i-understand-token-exposure)")
+	flag.BoolVar(&tokenExposureAck, "i-understand-token-exposure", false, "Acknowledge that --print-token writes the token where it may end up in logs or shell history")
+	flag.BoolVar(&revoke, "revoke", false, "Revoke the current token and delete the token file, then exit")
+	flag.BoolVar(&printTokenPath, "print-token-path", false, "Print the absolute --token-path after expansion and exit, without contacting Vault")
+	flag.BoolVar(&configCheck, "config-check", false, "Validate the flags and config file, print the resulting configuration with credentials redacted and exit, without contacting Vault")
+	flag.StringVar(&callbackPortRange, "callback-port-range", "", "With --native, range of local ports such as 8250-8260 to try in turn for the login callback listener, instead of --callback-port")
+	flag.BoolVar(&keepCallbackServer, "keep-callback-server", false, "With --native in daemon mode, keep the login callback listener running between logins, on the same port and redirect URI")
+	flag.StringVar(&redirectURI, "redirect-uri", "", "With --native, exact redirect URI to send to Vault and listen on instead of http://localhost:<callback-port>/oidc/callback, must be on a loopback address")
+	flag.IntVar(&callbackPort, "callback-port", 0, "Local port for the native login callback listener (0 picks a random port)")
+	flag.StringVar(&callbackAddr, "callback-addr", "127.0.0.1", "With --native, IP address the login callback listener binds to and the redirect URI points to, must be a loopback address")
+	flag.BoolVar(&allowRemoteCallback, "allow-remote-callback", false, "Allow a --callback-addr that isn't a loopback address, sending the authorization code over the network")
+	flag.StringVar(&browserCmd, "browser-cmd", "", "Command opening the native login URL, %s is replaced by the URL (defaults to BROWSER)")
+	flag.IntVar(&maxRetries, "max-retries", 3, "Number of times to retry a login failing with a transient error")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", 2*time.Second, "Delay before the first login retry, doubled on each further retry")
+	flag.DurationVar(&clockSkewTolerance, "clock-skew-tolerance", 30*time.Second, "Use the TTL computed by Vault when it differs from the local computation by more than this")
+	flag.BoolVar(&notify, "notify", false, "Show a desktop notification after a successful login")
+	flag.StringVar(&webhookURL, "webhook-url", "", "URL to POST a JSON event to after a successful login")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 5*time.Second, "Timeout of the --webhook-url request")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on in daemon mode, e.g. :9102")
+	flag.BoolVar(&dryRun, "dry-run", false, "Check the token but only log whether a login would be performed")
+	flag.BoolVar(&headless, "headless", false, "With --native, login through the device authorization flow instead of a local browser")
+	flag.BoolVar(&useTokenHelper, "use-token-helper", false, "Read and store the token through the token helper configured in ~/.vault instead of --token-path")
+	flag.StringVar(&proxy, "proxy", "", "HTTP(S) proxy for Vault requests, NO_PROXY is honored (defaults to HTTPS_PROXY or HTTP_PROXY)")
+	flag.StringVar(&socks5, "socks5", "", "SOCKS5 proxy to reach Vault through, as host:port or socks5://[user:password@]host:port")
+	flag.BoolVar(&abortOnLookupError, "abort-on-lookup-error", false, "Fail instead of logging in when the token lookup fails for reasons other than an expired or invalid token")
+	flag.StringVar(&postLoginHook, "post-login-hook", "", "Shell command to run after a successful login, with VAULT_TOKEN and VAULT_TOKEN_TTL set")
+	flag.BoolVar(&force, "force", false, "Login again even if the token TTL is above --min-ttl, e.g. to pick up policy changes")
+	flag.BoolVar(&renewOnly, "renew-only", false, "Only ever renew the token, failing instead of logging in when it can't be renewed above --min-ttl, e.g. on servers seeded with a renewable token")
+	flag.BoolVar(&healthCheck, "health-check", false, "Check that the Vault server is reachable and unsealed before looking at the token")
+	flag.IntVar(&healthRetries, "health-retries", 3, "Number of times to retry --health-check with a short backoff, e.g. during a leader election")
+	flag.Var(&requirePolicies, "require-policy", "Login again when the token lacks this policy, even if its TTL is above --min-ttl (repeatable, or comma separated)")
+	flag.StringVar(&lockFile, "lock-file", "", "File locked around logins so that concurrent runs don't login at once (defaults to --token-path with a .lock suffix)")
+	flag.StringVar(&ttlUnit, "ttl-unit", ttlUnitGo, "Unit of the TTLs in --status and text logs, either go (e.g. 72h0m0s), seconds or minutes")
+	flag.BoolVar(&backgroundRenew, "background-renew", false, "In daemon mode, keep renewing the token in the background and only login again once it reaches its maximum lifetime")
+	flag.DurationVar(&requestTTL, "request-ttl", 0, "TTL to ask for the token instead of the role default, applied by renewing it right after login (capped by the role max TTL)")
+	flag.DurationVar(&timeout, "timeout", 0, "Give up on the whole run after this duration, cancelling any login in progress (0 means no limit)")
+	flag.Var(&oidcParams, "oidc-param", "Extra key=value parameter of the OIDC authorization request, e.g. acr_values=mfa (repeatable, or comma separated)")
+	flag.StringVar(&tokenType, "token-type", "default", "Type of token to ask for at login, either service, batch or default to leave it to the role")
+	flag.IntVar(&numUses, "num-uses", 0, fmt.Sprintf("Number of uses to ask for the token at login, e.g. for short lived CI tokens, above %d since every check uses it once (0 leaves it to the role, disables --cache-file)", tokenmgr.FewUses))
+	flag.BoolVar(&dumpLookup, "dump-lookup", false, "Print the data of every token lookup to stderr as JSON, with the token itself redacted, to debug TTL issues")
+	flag.StringVar(&tokenFormat, "token-format", tokenmgr.TokenFormatRaw, "Format of the token file, either raw like the vault CLI writes it, or json for {\"token\":\"...\"}, which needs --native to login")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery flag can also be set through the environment, e.g. %sMIN_TTL for --min-ttl.\n", envPrefix)
+		fmt.Fprint(flag.CommandLine.Output(), exitCodesUsage)
+	}
 	flag.Parse()
 
-	if configFile == "" {
-		log.Fatalf("### error: --config-file must be specified")
+	if printVersion {
+		fmt.Printf("vault-periodic-oidc-login %s (commit %s, built %s)\n", version, commit, date)
+		os.Exit(0)
 	}
 
-	configData, err := os.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("### error reading config file: %v", err)
+	// Log in the default format until the configuration is fully resolved.
+	setupLogger(logFormatText, slog.LevelInfo, ttlUnitGo)
+
+	// Flags given on the command line win over their VPOL_ environment
+	// variables, which win over the config file, which wins over the generic
+	// VAULT_* environment, which wins over the flag defaults.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// Problems found with --config-check, which reports all of them instead
+	// of exiting at the first one.
+	var problems []error
+	configError := func(msg string, args ...any) {
+		if !configCheck {
+			exit(exitConfigError, msg, args...)
+		}
+		slog.Error(msg, args...)
+		problems = append(problems, errors.New(msg))
 	}
 
-	var cfg Config
-	err = yaml.Unmarshal(configData, &cfg)
+	if err := applyFlagValues(set, envFlagValues(), envPrefix+"* environment"); err != nil {
+		configError(err.Error())
+	}
+
+	if configFile == "" && profile != "" {
+		configError("error: --profile requires --config-file")
+	}
+
+	var tokenEntries []TokenEntry
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err == nil {
+			profile, err = applyConfig(cfg, set, profile)
+			tokenEntries = cfg.Tokens
+		}
+		if err != nil {
+			configError(err.Error())
+		}
+	}
+
+	// Flags set by any source but the generic environment, which is only a
+	// fallback and doesn't conflict with them.
+	explicit := maps.Clone(set)
+
+	err := applyFlagValues(set, map[string]string{
+		"vault-addr":  os.Getenv("VAULT_ADDR"),
+		"namespace":   os.Getenv("VAULT_NAMESPACE"),
+		"ca-cert":     os.Getenv("VAULT_CACERT"),
+		"ca-path":     os.Getenv("VAULT_CAPATH"),
+		"browser-cmd": os.Getenv("BROWSER"),
+		"proxy":       firstEnv("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"),
+	}, "environment")
 	if err != nil {
-		log.Fatalf("### error parsing config file: %v", err)
+		configError(err.Error())
+	}
+
+	if quiet && verbose {
+		configError("error: --quiet and --verbose are mutually exclusive")
 	}
 
-	vaultAddr := cfg.VaultAddr
-	minTTLStr := cfg.MinTTL
-	unexpandedTokenPath := cfg.TokenPath
+	logLevel := slog.LevelInfo
+	if quiet {
+		logLevel = slog.LevelError
+	} else if verbose {
+		logLevel = slog.LevelDebug
+	}
+	if checkOnly && !verbose {
+		// Above any level logs are emitted at.
+		logLevel = slog.LevelError + 1
+	}
 
-	minTTL, err := time.ParseDuration(minTTLStr)
+	switch ttlUnit {
+	case ttlUnitGo, ttlUnitSeconds, ttlUnitMinutes:
+	default:
+		configError(fmt.Sprintf("error: --ttl-unit must be one of %s, %s or %s", ttlUnitGo, ttlUnitSeconds, ttlUnitMinutes))
+	}
+
+	if err := setupLogger(logFormat, logLevel, ttlUnit); err != nil {
+		configError("error: " + err.Error())
+	}
+
+	if loginKillTimeout <= loginTimeout {
+		configError("error: --login-kill-timeout must be greater than --login-timeout")
+	}
+
+	if len(tokenEntries) > 0 {
+		if interval != 0 || printStatus || checkOnly || revoke || printToken || printTokenPath || useTokenHelper || cacheFile != "" || lockFile != "" {
+			configError("error: the tokens list of the config file can't be used with --interval, --status, --check-only, --revoke, --print-token, --print-token-path, --use-token-helper, --cache-file or --lock-file, each token is locked with its tokenPath and a .lock suffix")
+		}
+		defaults := TokenEntry{
+			VaultAddr: vaultAddr,
+			TokenPath: unexpandedTokenPath,
+			Role:      role,
+			MinTTL:    minTTLStr,
+			Namespace: namespace,
+		}
+		for i := range tokenEntries {
+			tokenEntries[i] = tokenEntries[i].withDefaults(defaults)
+		}
+		// The top-level settings are only defaults of the tokens, which are
+		// validated one by one later on.
+		vaultAddr, minTTLStr = tokenEntries[0].VaultAddr, tokenEntries[0].MinTTL
+	}
+
+	var vaultAddrs stringsFlag
+	vaultAddrs.Set(vaultAddr)
+	if vaultAddr == "" {
+		configError("error: --vault-addr must be set, in the config file or through VAULT_ADDR")
+	} else if len(vaultAddrs) == 0 {
+		configError("error: --vault-addr must not be empty")
+	}
+	for _, addr := range vaultAddrs {
+		if err := validateVaultAddr(addr); err != nil {
+			configError("error: --vault-addr must be an http:// or https:// URL, e.g. https://vault.example.com:8200", "vault_addr", addr)
+		}
+	}
+
+	if minTTLStr == "" && !printTokenPath && !revoke {
+		configError("error: --min-ttl must be set, either as a flag or in the config file")
+	}
+
+	var minTTL time.Duration
+	var minTTLPercent float64
+	if minTTLStr != "" {
+		minTTL, minTTLPercent, err = parseMinTTL(minTTLStr)
+		if err != nil {
+			configError("error: invalid --min-ttl", "min_ttl", minTTLStr, "error", err)
+		}
+	}
+
+	clientConfig := api.DefaultConfig()
+	if clientConfig.Error != nil {
+		configError("error reading vault client defaults", "error", clientConfig.Error)
+	}
+	if len(vaultAddrs) > 0 {
+		clientConfig.Address = vaultAddrs[0]
+	}
+
+	if tlsSkipVerify && (caCert != "" || caPath != "") {
+		if explicit["ca-cert"] || explicit["ca-path"] {
+			configError("error: --tls-skip-verify cannot be combined with --ca-cert or --ca-path")
+		}
+		// --tls-skip-verify wins over VAULT_CACERT and VAULT_CAPATH.
+		caCert, caPath = "", ""
+	}
+
+	if tlsSkipVerify {
+		slog.Warn("WARNING: tls verification is disabled, do not use --tls-skip-verify in production")
+	}
+
+	if (clientCert == "") != (clientKey == "") {
+		configError("error: --client-cert and --client-key must be given together")
+	}
+	for _, path := range []string{clientCert, clientKey} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			configError("error: cannot read client certificate", "error", err)
+		}
+	}
+
+	if caCert != "" || caPath != "" || tlsSkipVerify || clientCert != "" {
+		err = clientConfig.ConfigureTLS(&api.TLSConfig{
+			CACert:     caCert,
+			CAPath:     caPath,
+			ClientCert: clientCert,
+			ClientKey:  clientKey,
+			Insecure:   tlsSkipVerify,
+		})
+		if err != nil {
+			configError("error configuring vault client tls", "error", err)
+		}
+	}
+
+	if socks5 != "" && proxy != "" {
+		if explicit["proxy"] {
+			configError("error: --socks5 and --proxy can't be used together")
+		}
+		// --socks5 wins over HTTPS_PROXY and HTTP_PROXY.
+		proxy = ""
+	}
+
+	transport, canProxy := clientConfig.HttpClient.Transport.(*http.Transport)
+	if !canProxy && (proxy != "" || socks5 != "") {
+		configError("error: cannot configure a proxy on the vault client transport")
+	}
+
+	if proxy != "" && canProxy {
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  proxy,
+			HTTPSProxy: proxy,
+			NoProxy:    firstEnv("NO_PROXY", "no_proxy"),
+		}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	if socks5 != "" {
+		if !strings.Contains(socks5, "://") {
+			socks5 = "socks5://" + socks5
+		}
+		dialer, err := socks5Dialer(socks5)
+		if err != nil {
+			configError("error: "+err.Error(), "socks5", socks5)
+		} else if canProxy {
+			// Dial everything through the tunnel, HTTP(S)_PROXY included.
+			transport.Proxy = nil
+			transport.DialContext = dialer.DialContext
+		}
+	}
+
+	client, err := api.NewClient(clientConfig)
 	if err != nil {
-		log.Fatalf("### error parsing minTTL duration: %v", err)
+		configError("error creating vault client", "error", err)
+	} else if namespace != "" {
+		client.SetNamespace(namespace)
 	}
 
-	client, err := api.NewClient(&api.Config{
-		Address: vaultAddr,
-	})
+	var tokenPath string
+	if len(vaultAddrs) > 0 {
+		tokenPath, err = expandTokenPath(unexpandedTokenPath, vaultAddrs[0], profile)
+		if err != nil {
+			configError("error: invalid --token-path", "error", err)
+		}
+	}
+
+	if tokenPath == tokenmgr.StdinTokenPath && !printStatus && !checkOnly && !dryRun {
+		configError("error: --token-path - reads the token from stdin, which only works with --status, --check-only or --dry-run")
+	}
+
+	if printTokenPath {
+		absTokenPath, err := filepath.Abs(tokenPath)
+		if err != nil {
+			configError("error: invalid --token-path", "error", err)
+		}
+		fmt.Println(absTokenPath)
+		os.Exit(0)
+	}
+
+	opts := options{
+		tokenPath: tokenPath,
+		output:    output,
+		ttlUnit:   ttlUnit,
+
+		backgroundRenew: backgroundRenew,
+		metricsAddr:     metricsAddr,
+
+		pidFile: pidFile,
+
+		auditLog: auditLog,
+
+		shutdownGrace: shutdownGrace,
+	}
+
+	cfg := tokenmgr.Config{
+		TokenPath: tokenPath,
+		MinTTL:    minTTL,
+
+		MinTTLPercent: minTTLPercent,
+		Native:        native,
+		Headless:      headless,
+		Method:        method,
+		LoginParams:   loginParams,
+		MountPath:     mountPath,
+		Role:          role,
+		Namespace:     namespace,
+
+		LoginTimeout:     loginTimeout,
+		LoginKillTimeout: loginKillTimeout,
+
+		CallbackPort: callbackPort,
+		CallbackAddr: callbackAddr,
+		BrowserCmd:   browserCmd,
+
+		MaxRetries:     maxRetries,
+		RetryBaseDelay: retryBaseDelay,
+
+		ClockSkewTolerance: clockSkewTolerance,
+
+		Notify: notify,
+
+		WebhookURL:     webhookURL,
+		WebhookTimeout: webhookTimeout,
+
+		DryRun: dryRun,
+
+		Proxy:  proxy,
+		SOCKS5: socks5,
+
+		AbortOnLookupError: abortOnLookupError,
+
+		PostLoginHook: postLoginHook,
+
+		Force:     force,
+		RenewOnly: renewOnly,
+
+		RequirePolicies: requirePolicies,
+
+		Addresses: vaultAddrs,
+
+		LockFile: os.ExpandEnv(lockFile),
+
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+
+		RequestTTL: requestTTL,
+
+		OIDCParams: oidcParams,
+
+		TokenType: tokenType,
+		NumUses:   numUses,
+
+		MinLoginInterval: minLoginInterval,
+
+		RedirectURI: redirectURI,
+
+		HealthRetries: healthRetries,
+
+		KeepCallbackServer: keepCallbackServer,
+
+		CacheFile: cacheFile,
+
+		Env: loginEnv,
+
+		TokenFormat: tokenFormat,
+	}
+	if cfg.LockFile == "" {
+		cfg.LockFile = tokenPath + ".lock"
+	}
+	// Keep stdout reserved for the JSON report or the token.
+	if opts.output == outputJSON || printToken {
+		cfg.Stdout = os.Stderr
+	}
+
+	if dumpLookup {
+		cfg.DumpLookup = os.Stderr
+	}
+
+	if useTokenHelper {
+		cfg.TokenHelper, err = tokenmgr.TokenHelperPath()
+		if err != nil {
+			configError("error finding token helper", "error", err)
+		}
+		slog.Debug("using token helper", "token_helper", cfg.TokenHelper)
+	}
+
+	if cfg.CallbackPort < 0 || cfg.CallbackPort > 65535 {
+		configError("error: --callback-port must be between 0 and 65535")
+	}
+
+	if cfg.Headless && !cfg.Native {
+		configError("error: --headless requires --native")
+	}
+
+	if opts.metricsAddr != "" && interval == 0 {
+		configError("error: --metrics-addr requires --interval")
+	}
+
+	if keepCallbackServer && interval == 0 {
+		configError("error: --keep-callback-server requires --interval")
+	}
+
+	if renewOnly && (force || len(requirePolicies) > 0) {
+		configError("error: --renew-only can't be used with --force or --require-policy, which need a login")
+	}
+
+	if opts.shutdownGrace < 0 {
+		configError("error: --shutdown-grace must not be negative")
+	}
+	if opts.shutdownGrace > 0 && interval == 0 {
+		configError("error: --shutdown-grace requires --interval")
+	}
+
+	if opts.pidFile != "" && interval == 0 {
+		configError("error: --pid-file requires --interval")
+	}
+
+	if opts.backgroundRenew && interval == 0 {
+		configError("error: --background-renew requires --interval")
+	}
+
+	if jitter < 0 {
+		configError("error: --jitter must not be negative")
+	}
+	if jitter > 0 && interval == 0 {
+		configError("error: --jitter requires --interval")
+	}
+
+	switch tokenType {
+	case "service", "batch":
+	case "default":
+		cfg.TokenType = ""
+	default:
+		configError("error: --token-type must be service, batch or default", "token_type", tokenType)
+	}
+
+	if callbackPortRange != "" {
+		if callbackPort != 0 || redirectURI != "" {
+			configError("error: --callback-port-range can't be used with --callback-port or --redirect-uri")
+		}
+		first, last, ok := strings.Cut(callbackPortRange, "-")
+		cfg.CallbackPortRange[0], err = strconv.Atoi(first)
+		if err == nil {
+			cfg.CallbackPortRange[1], err = strconv.Atoi(last)
+		}
+		if !ok || err != nil || cfg.CallbackPortRange[0] < 1 || cfg.CallbackPortRange[0] > cfg.CallbackPortRange[1] || cfg.CallbackPortRange[1] > 65535 {
+			configError("error: --callback-port-range must be like 8250-8260", "callback_port_range", callbackPortRange)
+		}
+	}
+
+	if set["callback-addr"] {
+		if redirectURI != "" {
+			configError("error: --callback-addr and --redirect-uri can't be used together, put the address in the redirect uri")
+		}
+		ip := net.ParseIP(callbackAddr)
+		if ip == nil || ip.IsUnspecified() {
+			configError("error: --callback-addr must be an IP address of this machine, not a host name or 0.0.0.0", "callback_addr", callbackAddr)
+		}
+		if !ip.IsLoopback() {
+			if !allowRemoteCallback {
+				configError("error: --callback-addr must be a loopback address, unless --allow-remote-callback is given", "callback_addr", callbackAddr)
+			}
+			slog.Warn("WARNING: the login callback listens on a non-loopback address, the authorization code goes over the network", "callback_addr", callbackAddr)
+		}
+	}
+
+	if redirectURI != "" {
+		if callbackPort != 0 {
+			configError("error: --redirect-uri and --callback-port can't be used together, put the port in the redirect uri")
+		}
+		if err := validateRedirectURI(redirectURI); err != nil {
+			configError("error: invalid --redirect-uri", "redirect_uri", redirectURI, "error", err)
+		}
+	}
+
+	if printToken {
+		if !tokenExposureAck {
+			configError("error: --print-token requires --i-understand-token-exposure")
+		}
+		if interval != 0 || dryRun || opts.output == outputJSON {
+			configError("error: --print-token can't be used with --interval, --dry-run or --output json")
+		}
+	}
+
+	switch tokenFormat {
+	case tokenmgr.TokenFormatRaw:
+	case tokenmgr.TokenFormatJSON:
+		if useTokenHelper {
+			configError("error: --token-format json can't be used with --use-token-helper, which stores the token itself")
+		}
+		if !native && !printStatus && !checkOnly && !dryRun && !revoke {
+			configError("error: --token-format json needs --native, the vault CLI only writes raw token files")
+		}
+	default:
+		configError(fmt.Sprintf("error: --token-format must be either %s or %s", tokenmgr.TokenFormatRaw, tokenmgr.TokenFormatJSON), "token_format", tokenFormat)
+	}
+
+	if cacheFile != "" && (useTokenHelper || tokenPath == tokenmgr.StdinTokenPath) {
+		configError("error: --cache-file needs the token in a file, it can't be used with --use-token-helper or --token-path -")
+	}
+
+	if successMessage != "" {
+		tmpl, err := template.New("success-message").Parse(successMessage)
+		if err == nil {
+			// Catches unknown fields, which parsing doesn't.
+			err = tmpl.Execute(io.Discard, tokenmgr.SuccessMessageData{})
+		}
+		if err != nil {
+			configError("error: invalid --success-message", "error", err)
+		}
+		cfg.SuccessMessage = tmpl
+	}
+
+	if numUses < 0 {
+		configError("error: --num-uses must not be negative")
+	}
+	if numUses > 0 && numUses <= tokenmgr.FewUses {
+		configError(fmt.Sprintf("error: --num-uses must be above %d, the uses left at which the token is refreshed", tokenmgr.FewUses))
+	}
+
+	cfg.Role, cfg.FallbackRoles, err = splitRoles(role)
 	if err != nil {
-		log.Fatalf("### error creating vault client: %v", err)
+		configError("error: invalid --role", "role", role, "error", err)
+	}
+
+	if healthRetries < 0 {
+		configError("error: --health-retries must not be negative")
+	}
+
+	if minLoginInterval < 0 {
+		configError("error: --min-login-interval must not be negative")
+	}
+
+	if requestTTL < 0 {
+		configError("error: --request-ttl must not be negative")
+	}
+
+	if cfg.MaxRetries < 0 {
+		configError("error: --max-retries must not be negative")
+	}
+
+	if mountPath != "" && strings.Trim(mountPath, "/") == "" {
+		configError("error: --mount-path must not be empty")
+	}
+
+	switch method {
+	case tokenmgr.MethodOIDC:
+	case tokenmgr.MethodJWT, tokenmgr.MethodGitHub:
+		if headless {
+			configError("error: --headless only works with --method oidc")
+		}
+		if method == tokenmgr.MethodJWT && !native && !printStatus && !checkOnly && !dryRun && !revoke {
+			configError("error: --method jwt needs --native, the vault CLI has no jwt login")
+		}
+	default:
+		configError("error: --method must be oidc, jwt or github", "method", method)
+	}
+
+	if opts.output != outputText && opts.output != outputJSON {
+		configError(fmt.Sprintf("error: --output must be either %s or %s", outputText, outputJSON))
+	}
+
+	if timeout < 0 {
+		configError("error: --timeout must not be negative")
+	}
+
+	if configCheck {
+		if len(tokenEntries) > 0 && client != nil {
+			if _, err := tokenRuns(tokenEntries, client, cfg, profile); err != nil {
+				configError("error: " + err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			exit(exitConfigError, "error: the configuration is invalid", "problems", len(problems))
+		}
+		printConfig(set, tokenEntries)
+		slog.Info("configuration is valid")
+		os.Exit(0)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if len(tokenEntries) > 0 {
+		runs, err := tokenRuns(tokenEntries, client, cfg, profile)
+		if err != nil {
+			exit(exitConfigError, "error: "+err.Error())
+		}
+		code := checkTokens(ctx, runs, opts, healthCheck)
+		exitOnTimeout(ctx, timeout)
+		os.Exit(code)
 	}
 
-	tokenPath := os.ExpandEnv(unexpandedTokenPath)
-	currTTL := ttl(client, tokenPath)
-	if currTTL > minTTL {
-		log.Printf("### token ttl is not expiring soon: %v", currTTL)
+	m := tokenmgr.New(client, cfg)
+
+	if healthCheck {
+		if err := m.CheckHealth(ctx); err != nil {
+			exitOnTimeout(ctx, timeout)
+			exit(exitLoginFailed, "error: vault server is not usable", "vault_addr", vaultAddr, "error", err)
+		}
+	}
+
+	if checkOnly {
+		code := probe(ctx, m)
+		exitOnTimeout(ctx, timeout)
+		os.Exit(code)
+	}
+
+	if printStatus {
+		code := status(ctx, m, opts)
+		exitOnTimeout(ctx, timeout)
+		os.Exit(code)
+	}
+
+	if revoke {
+		err := m.Revoke(ctx)
+		exitOnTimeout(ctx, timeout)
+		if errors.Is(err, tokenmgr.ErrNoToken) {
+			slog.Info("no token to revoke", "token_path", tokenPath)
+		} else if err != nil {
+			exit(exitLoginFailed, "error: --revoke failed", "error", err)
+		} else {
+			slog.Info("revoked token", "token_path", tokenPath)
+		}
 		os.Exit(0)
 	}
 
-	if err := oidcLogin(client); err != nil {
-		log.Fatalf("### error doing vault login: %v", err)
+	if interval == 0 {
+		res, err := m.Check(ctx)
+		report(opts, res, err)
+		audit(opts, m.Address(), res, err)
+		exitOnTimeout(ctx, timeout)
+		if errors.Is(err, tokenmgr.ErrPostLoginHook) {
+			exit(exitHookFailed, "error running post-login hook", "error", err)
+		} else if err != nil {
+			exit(exitLoginFailed, "error doing vault login", append([]any{"action", actionLoginFailed, "error", err}, hintArgs(err)...)...)
+		}
+		if printToken {
+			fmt.Println(client.Token())
+		}
+		switch res.Action {
+		case tokenmgr.ActionSkipped:
+			os.Exit(exitTokenValid)
+		case tokenmgr.ActionWouldLogin:
+			os.Exit(exitNeedsLogin)
+		}
+		os.Exit(exitRefreshed)
 	}
 
-	log.Printf("### current token ttl is now %v", ttl(client, tokenPath))
-	os.Exit(0)
+	clean := daemon(ctx, m, opts, interval, jitter)
+	m.Close()
+	exitOnTimeout(ctx, timeout)
+	if !clean {
+		exit(exitShutdown, "error: shutdown cancelled a check in progress", "shutdown_grace", shutdownGrace.String())
+	}
 }
 
-// Returns the TTL given the path to the token.
-func ttl(client *api.Client, tokenPath string) time.Duration {
-	if _, err := os.Stat(tokenPath); os.IsNotExist(err) {
-		return 0
-	} else if err != nil {
-		log.Printf("### error accessing token file: %v", err)
-		return 0
+// Splits a --role into the role to login with and the ones to fall back to,
+// in order.
+func splitRoles(s string) (string, []string, error) {
+	if !strings.Contains(s, ",") {
+		return s, nil, nil
 	}
 
-	tokenData, err := os.ReadFile(tokenPath)
-	if err != nil {
-		log.Printf("### error reading token file: %v", err)
-		return 0
+	roles := strings.Split(s, ",")
+	for i := range roles {
+		roles[i] = strings.TrimSpace(roles[i])
+		if roles[i] == "" {
+			return "", nil, fmt.Errorf("empty role in list")
+		}
 	}
+	return roles[0], roles[1:], nil
+}
 
-	token := string(tokenData)
-	client.SetToken(token)
+// Returns a hint attribute telling which flags get around err, if any.
+func hintArgs(err error) []any {
+	var hint string
+	switch {
+	case errors.Is(err, tokenmgr.ErrNotInteractive):
+		hint = "use --native --headless or login interactively"
+	case errors.Is(err, tokenmgr.ErrLoginDisabled):
+		hint = "--renew-only is set"
+	case errors.Is(err, tokenmgr.ErrVaultBinaryMissing):
+		hint = "use --native to login without the vault CLI"
+	case errors.Is(err, tokenmgr.ErrCallbackInUse):
+		hint = "pick another port with --callback-port, --callback-port-range or --redirect-uri"
+	default:
+		return nil
+	}
+	return []any{"hint", hint}
+}
 
-	secret, err := client.Auth().Token().LookupSelf()
+// Checks that addr is the URL of a Vault server.
+func validateVaultAddr(addr string) error {
+	u, err := url.Parse(addr)
 	if err != nil {
-		log.Printf("### error looking up token: %v", err)
-		return 0
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http:// or https:// URL")
 	}
+	return nil
+}
 
-	expireTimeRaw, ok := secret.Data["expire_time"]
-	if !ok {
-		log.Printf("### expire_time not found in token lookup data")
-		return 0
+// Parses a --min-ttl, either a duration or a percentage of the token
+// lifetime such as 20%.
+func parseMinTTL(s string) (time.Duration, float64, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		minTTLPercent, err := strconv.ParseFloat(percent, 64)
+		if err != nil || minTTLPercent <= 0 || minTTLPercent > 100 {
+			return 0, 0, fmt.Errorf("percentage must be between 0 and 100")
+		}
+		return 0, minTTLPercent, nil
 	}
 
-	expireTimeStr, ok := expireTimeRaw.(string)
-	if !ok {
-		log.Printf("### expire_time is not a string")
-		return 0
+	minTTL, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if minTTL <= 0 {
+		return 0, 0, fmt.Errorf("must be positive")
 	}
+	return minTTL, 0, nil
+}
 
-	expireTime, err := time.Parse(time.RFC3339Nano, expireTimeStr)
+// Checks that the redirect URI of the native flow points to a port of this
+// machine, so that the authorization code can't be sent anywhere else.
+func validateRedirectURI(redirectURI string) error {
+	u, err := url.Parse(redirectURI)
 	if err != nil {
-		log.Printf("### error parsing expire_time: %v", err)
-		return 0
+		return err
+	}
+	if u.Scheme != "http" {
+		return fmt.Errorf("scheme must be http")
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("port is missing")
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("host must be localhost or a loopback address")
+	}
+	if u.Path == "" {
+		return fmt.Errorf("path is missing")
+	}
+	return nil
+}
+
+// Flag collecting the values of each of its occurrences, which can also be
+// comma separated lists.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
 	}
+	return nil
+}
 
-	ttlDuration := time.Until(expireTime)
+// Flag collecting key=value pairs from each of its occurrences, which can
+// also be comma separated lists.
+type keyValuesFlag map[string]string
 
-	return ttlDuration
+func (f *keyValuesFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for k, v := range *f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-// Launches `vault` CLI and performs OIDC login using the browser.
-func oidcLogin(client *api.Client) error {
-	cmd := exec.Command("vault", "login", "-method=oidc", "-address", client.Address())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+func (f *keyValuesFlag) Set(value string) error {
+	if *f == nil {
+		*f = keyValuesFlag{}
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected key=value, got %q", pair)
+		}
+		(*f)[k] = v
+	}
+	return nil
+}
 
-	err := cmd.Start()
+// Returns the value of the first of the environment variables that is set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Exits with exitTimeout if ctx expired because of --timeout.
+func exitOnTimeout(ctx context.Context, timeout time.Duration) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		exit(exitTimeout, fmt.Sprintf("error: timed out after %v", timeout))
+	}
+}
+
+// Applies the settings of the selected profile of cfg, then those of cfg
+// itself, to the flags not set yet. Returns the name of the profile.
+func applyConfig(cfg Config, set map[string]bool, profile string) (string, error) {
+	profile, err := cfg.selectProfile(profile)
 	if err != nil {
-		return fmt.Errorf("error starting vault login: %v", err)
+		return "", fmt.Errorf("error: %v", err)
+	}
+	if profile != "" {
+		err := applyFlagValues(set, cfg.Profiles[profile].flagValues(), fmt.Sprintf("profile %q", profile))
+		if err != nil {
+			return "", err
+		}
+		slog.Debug("using profile", "profile", profile)
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
+	return profile, applyFlagValues(set, cfg.flagValues(), "config file")
+}
+
+// Returns a dialer going through the SOCKS5 proxy at addr, a socks5:// URL.
+func socks5Dialer(addr string) (xproxy.ContextDialer, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "socks5" || u.Host == "" {
+		return nil, errors.New("--socks5 must be host:port or socks5://[user:password@]host:port")
+	}
+	dialer, err := xproxy.FromURL(u, xproxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --socks5 proxy: %v", err)
+	}
+	contextDialer, ok := dialer.(xproxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("the --socks5 dialer doesn't support contexts")
+	}
+	return contextDialer, nil
+}
 
-	termTimer := time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Sending SIGTERM to vault login process")
-		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
-			log.Printf("Error sending SIGTERM: %v", err)
+// Logs the message at error level and exits with the given code.
+func exit(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
+}
+
+// Runs check right away, then again every interval plus a random delay of up
+// to jitter, until ctx is cancelled.
+func daemon(ctx context.Context, m *tokenmgr.Manager, opts options, interval, jitter time.Duration) (clean bool) {
+	if opts.pidFile != "" {
+		if err := writePIDFile(opts.pidFile); err != nil {
+			exit(exitConfigError, "error: "+err.Error())
 		}
-	})
+		defer removePIDFile(opts.pidFile)
+	}
+
+	if opts.metricsAddr != "" {
+		server := startMetricsServer(opts.metricsAddr)
+		defer stopMetricsServer(server)
+	}
+
+	slog.Info("checking token periodically", "interval", interval.String(), "jitter", jitter.String())
+
+	var renewDone <-chan struct{}
+	// Set when the token can't be renewed in background, until a login
+	// replaces it.
+	renewFailed := false
+	stopRenew := func() {}
+	defer func() { stopRenew() }()
+
+	checkNow := make(chan os.Signal, 1)
+	if len(checkSignals) > 0 {
+		signal.Notify(checkNow, checkSignals...)
+		defer signal.Stop(checkNow)
+	}
 
-	killTimer := time.AfterFunc(90*time.Second, func() {
-		log.Printf("Sending SIGKILL to vault login process")
-		if err := cmd.Process.Kill(); err != nil {
-			log.Printf("Error sending SIGKILL: %v", err)
+	relogin, recheck := false, false
+	for {
+		check := m.Check
+		if relogin {
+			check = m.Relogin
+		} else if recheck {
+			check = m.Recheck
+		}
+		res, cancelled, err := withShutdownGrace(ctx, opts.shutdownGrace, check)
+		relogin, recheck = false, false
+		if cancelled {
+			return false
+		}
+		report(opts, res, err)
+		audit(opts, m.Address(), res, err)
+		if err != nil {
+			slog.Error("error doing vault login", append([]any{"action", actionLoginFailed, "error", err}, hintArgs(err)...)...)
 		}
-	})
 
-	err = <-done
+		// A new token needs a new renewer.
+		if opts.backgroundRenew && ((renewDone == nil && !renewFailed) || res.Action == tokenmgr.ActionLoggedIn) {
+			stopRenew()
+			var stop func()
+			renewDone, stop, err = m.RenewInBackground(ctx)
+			renewFailed = err != nil
+			if err != nil {
+				slog.Info("not renewing token in background", "error", err)
+				stop = func() {}
+			}
+			stopRenew = stop
+		}
 
-	termTimer.Stop()
-	killTimer.Stop()
+		wait := interval
+		if jitter > 0 {
+			wait += rand.N(jitter)
+		}
+		slog.Debug("waiting before checking token again", "wait", wait.String())
 
-	if err != nil {
-		return fmt.Errorf("error during OIDC login: %v", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			slog.Debug("interval elapsed, checking token again")
+		case <-renewDone:
+			timer.Stop()
+			renewDone = nil
+			relogin = true
+			slog.Info("token can no longer be renewed, logging in again")
+		case sig := <-checkNow:
+			timer.Stop()
+			recheck = true
+			slog.Info("check triggered by signal, checking token now", "signal", sig.String())
+		case <-ctx.Done():
+			timer.Stop()
+			if ctx.Err() == context.Canceled {
+				slog.Info("received signal, exiting")
+			}
+			return true
+		}
 	}
-	log.Printf("Logged in using OIDC successfully.")
+}
 
-	return nil
+// Runs check, which carries on after a signal cancels ctx for up to grace
+// before being cancelled too. Reports whether check had to be cancelled.
+func withShutdownGrace(ctx context.Context, grace time.Duration, check func(context.Context) (tokenmgr.Result, error)) (tokenmgr.Result, bool, error) {
+	checkCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	type outcome struct {
+		res tokenmgr.Result
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := check(checkCtx)
+		done <- outcome{res, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.res, false, o.err
+	case <-ctx.Done():
+	}
+
+	// --timeout bounds the whole run, grace included.
+	if ctx.Err() == context.Canceled && grace > 0 {
+		slog.Info("received signal, waiting for the check in progress to finish", "shutdown_grace", grace.String())
+		select {
+		case o := <-done:
+			slog.Info("check in progress finished")
+			return o.res, false, o.err
+		case <-time.After(grace):
+			slog.Warn("shutdown grace period elapsed, cancelling the check in progress")
+		}
+	}
+
+	cancel()
+	o := <-done
+	return o.res, true, o.err
 }
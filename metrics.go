@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Starts serving /metrics on addr in the background.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		slog.Info("serving metrics", "metrics_addr", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serving metrics", "metrics_addr", addr, "error", err)
+		}
+	}()
+
+	return server
+}
+
+// Stops the metrics server, waiting a few seconds for in-flight scrapes.
+func stopMetricsServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down metrics server", "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/giuscri/vault-periodic-oidc-login/tokenmgr"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Units of -ttl-unit.
+const (
+	ttlUnitGo      = "go"
+	ttlUnitSeconds = "seconds"
+	ttlUnitMinutes = "minutes"
+)
+
+// Formats a token TTL in the given -ttl-unit, whole seconds or minutes
+// without a suffix, or a Go duration rounded to the second.
+func formatTTL(d time.Duration, unit string) string {
+	switch unit {
+	case ttlUnitSeconds:
+		return strconv.FormatInt(int64(d.Seconds()), 10)
+	case ttlUnitMinutes:
+		return strconv.FormatInt(int64(d.Minutes()), 10)
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// Only used in logs, a failed check has no action in the JSON report.
+const actionLoginFailed = "login_failed"
+
+// JSON rendering of a check, printed on stdout with `-output json`.
+type jsonReport struct {
+	// Only set when checking the tokens list of the config file.
+	TokenPath string `json:"token_path,omitempty"`
+	VaultAddr string `json:"vault_addr,omitempty"`
+
+	Action     tokenmgr.Action `json:"action,omitempty"`
+	TTLSeconds int64           `json:"ttl_seconds"`
+	Accessor   string          `json:"accessor,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	Error      *string         `json:"error"`
+}
+
+// Prints the outcome of a check in the requested output format.
+func report(opts options, res tokenmgr.Result, err error) {
+	if opts.output != outputJSON {
+		return
+	}
+	printJSON(newJSONReport(res, err))
+}
+
+// Returns the JSON rendering of the outcome of a check.
+func newJSONReport(res tokenmgr.Result, err error) jsonReport {
+	r := jsonReport{
+		Action:     res.Action,
+		TTLSeconds: int64(res.TTL.Seconds()),
+		Accessor:   res.Accessor,
+		Warnings:   res.Warnings,
+	}
+	if err != nil {
+		msg := err.Error()
+		r.Error = &msg
+	}
+	return r
+}
+
+// Prints r on a line of stdout.
+func printJSON(r jsonReport) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("error encoding json output", "error", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// Line appended to --audit-log for every check.
+type auditRecord struct {
+	Time       string          `json:"time"`
+	VaultAddr  string          `json:"vault_addr"`
+	Action     tokenmgr.Action `json:"action"`
+	TTLSeconds int64           `json:"ttl_seconds"`
+	Accessor   string          `json:"accessor,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Appends the outcome of a check to --audit-log, only logging failures so
+// that auditing never gets in the way of the token refresh.
+func audit(opts options, vaultAddr string, res tokenmgr.Result, err error) {
+	if opts.auditLog == "" {
+		return
+	}
+
+	r := auditRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		VaultAddr:  vaultAddr,
+		Action:     res.Action,
+		TTLSeconds: int64(res.TTL.Seconds()),
+		Accessor:   res.Accessor,
+	}
+	if err != nil {
+		// A failing post-login hook comes with the login that preceded it.
+		if r.Action == "" {
+			r.Action = actionLoginFailed
+		}
+		r.Error = err.Error()
+	}
+
+	data, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		slog.Error("error encoding audit log record", "error", jsonErr)
+		return
+	}
+
+	f, fileErr := os.OpenFile(opts.auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if fileErr != nil {
+		slog.Error("error opening audit log", "audit_log", opts.auditLog, "error", fileErr)
+		return
+	}
+	defer f.Close()
+
+	if _, fileErr := f.Write(append(data, '\n')); fileErr != nil {
+		slog.Error("error writing audit log", "audit_log", opts.auditLog, "error", fileErr)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Writes the PID of this process to path, refusing to if it already holds
+// the PID of a live process. A stale PID file is overwritten.
+func writePIDFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("pid file %s points to running process %d, is another daemon running?", path, pid)
+		}
+		slog.Info("overwriting stale pid file", "pid_file", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading pid file: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing pid file: %v", err)
+	}
+	return nil
+}
+
+// Removes the PID file at path, unless another process took it over.
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("error reading pid file", "pid_file", path, "error", err)
+		return
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		slog.Warn("pid file was taken over by another process, leaving it", "pid_file", path)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Error("error removing pid file", "pid_file", path, "error", err)
+	}
+}
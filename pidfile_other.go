@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Reports whether a process with this PID exists.
+func processAlive(pid int) bool {
+	// Only succeeds for existing processes outside of unix.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Reports whether a process with this PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means it exists but belongs to another user.
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
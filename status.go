@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/giuscri/vault-periodic-oidc-login/tokenmgr"
+)
+
+// JSON rendering of --status.
+type statusReport struct {
+	TTLSeconds int64    `json:"ttl_seconds"`
+	Valid      bool     `json:"valid"`
+	Warnings   []string `json:"warnings,omitempty"`
+
+	// Metadata of the token lookup, never the token itself.
+	CreationTime       string `json:"creation_time,omitempty"`
+	CreationTTLSeconds int64  `json:"creation_ttl_seconds"`
+	Renewable          bool   `json:"renewable"`
+	NumUses            int64  `json:"num_uses"`
+}
+
+// Prints the TTL of the current token without any side effect, returning
+// the exit code telling whether the token is above --min-ttl.
+func status(ctx context.Context, m *tokenmgr.Manager, opts options) int {
+	info, err := m.Lookup(ctx)
+	if err != nil && !errors.Is(err, tokenmgr.ErrNoToken) {
+		slog.Error("error looking up token", "token_path", opts.tokenPath, "error", err)
+	}
+	currTTL := info.TTL
+	valid := currTTL > m.MinTTL(info) || info.NoExpiry
+
+	var creationTime string
+	if !info.CreationTime.IsZero() {
+		creationTime = info.CreationTime.UTC().Format(time.RFC3339)
+	}
+
+	if opts.output == outputJSON {
+		data, err := json.Marshal(statusReport{
+			TTLSeconds: int64(currTTL.Seconds()),
+			Valid:      valid,
+			Warnings:   info.Warnings,
+
+			CreationTime:       creationTime,
+			CreationTTLSeconds: int64(info.CreationTTL.Seconds()),
+			Renewable:          info.Renewable,
+			NumUses:            info.NumUses,
+		})
+		if err != nil {
+			slog.Error("error encoding json output", "error", err)
+			return exitConfigError
+		}
+		fmt.Println(string(data))
+	} else {
+		// Stdout keeps only the TTL for scripts, the rest goes to the logs.
+		if err == nil {
+			slog.Info("token metadata", "creation_time", creationTime, "creation_ttl", formatTTL(info.CreationTTL, opts.ttlUnit), "renewable", info.Renewable, "num_uses", info.NumUses)
+		}
+		fmt.Println(formatTTL(currTTL, opts.ttlUnit))
+	}
+
+	if !valid {
+		return exitNeedsLogin
+	}
+	return exitTokenValid
+}
+
+// Returns the exit code telling whether the token is above --min-ttl,
+// without printing anything.
+func probe(ctx context.Context, m *tokenmgr.Manager) int {
+	info, err := m.Lookup(ctx)
+	if err != nil {
+		slog.Debug("error looking up token", "error", err)
+		return exitNeedsLogin
+	}
+	if info.TTL <= m.MinTTL(info) && !info.NoExpiry {
+		slog.Debug("token ttl is below min ttl", "ttl", info.TTL.String(), "min_ttl", m.MinTTL(info).String())
+		return exitNeedsLogin
+	}
+	return exitTokenValid
+}
@@ -0,0 +1,109 @@
+package tokenmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Contents of Config.CacheFile, remembering the last token lookup so that
+// frequent runs don't need to ask Vault again.
+type lookupCache struct {
+	ExpireTime time.Time `json:"expire_time"`
+	// Time past which the token needs a refresh, the expiry minus min TTL.
+	RefreshAt time.Time `json:"refresh_at"`
+	ReadAt    time.Time `json:"read_at"`
+	// Modification time of the token file the cache is about, replacing
+	// the token invalidates the cache.
+	TokenModTime time.Time `json:"token_mtime"`
+	// Accessor of the token, never the token itself, and the Vault server
+	// it was looked up on. Entries of another token or server are ignored.
+	Accessor  string `json:"accessor"`
+	VaultAddr string `json:"vault_addr"`
+}
+
+// Returns the result of a check according to the cache, with ok false
+// if asking Vault is needed.
+func (m *Manager) cachedCheck() (res Result, ok bool) {
+	data, err := os.ReadFile(m.cfg.CacheFile)
+	if os.IsNotExist(err) {
+		return Result{}, false
+	} else if err != nil {
+		slog.Warn("error reading cache file", "cache_file", m.cfg.CacheFile, "error", err)
+		return Result{}, false
+	}
+
+	var cache lookupCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		slog.Warn("error parsing cache file", "cache_file", m.cfg.CacheFile, "error", err)
+		return Result{}, false
+	}
+
+	if cache.Accessor == "" || cache.VaultAddr != m.client.Address() {
+		slog.Debug("cache file is about another token or vault server", "cache_file", m.cfg.CacheFile, "vault_addr", cache.VaultAddr)
+		return Result{}, false
+	}
+
+	tokenInfo, err := os.Stat(m.cfg.TokenPath)
+	if err != nil || !tokenInfo.ModTime().Equal(cache.TokenModTime) {
+		slog.Debug("token file changed since it was cached", "cache_file", m.cfg.CacheFile)
+		return Result{}, false
+	}
+	if !time.Now().Before(cache.RefreshAt) {
+		slog.Debug("cached token is due for a refresh", "cache_file", m.cfg.CacheFile, "refresh_at", cache.RefreshAt.Format(time.RFC3339))
+		return Result{}, false
+	}
+
+	// Callers expect the client to use the token, as after a lookup.
+	token, err := readToken(m.cfg.TokenPath, m.cfg.TokenFormat)
+	if err != nil || token == "" || !plausibleToken(token) {
+		slog.Debug("cached token file can't be read", "cache_file", m.cfg.CacheFile, "error", err)
+		return Result{}, false
+	}
+	m.client.SetToken(token)
+
+	ttl := time.Until(cache.ExpireTime).Round(time.Second)
+	slog.Info("cached token ttl is not expiring soon", ttlAttr(ttl), "token_path", m.cfg.TokenPath, "read_at", cache.ReadAt.Format(time.RFC3339), "action", ActionSkipped)
+	return Result{Action: ActionSkipped, TTL: ttl, Accessor: cache.Accessor}, true
+}
+
+// Caches the ttl and accessor of the token, refreshed once below minTTL.
+// Failures are only logged since the cache merely saves lookups.
+func (m *Manager) saveCache(ttl, minTTL time.Duration, accessor string) {
+	if m.cfg.CacheFile == "" || m.cfg.NumUses > 0 || accessor == "" {
+		return
+	}
+	if _, err := os.Stat(m.cfg.TokenPath); os.IsNotExist(err) {
+		// The token comes from VAULT_TOKEN, whose changes can't be told.
+		slog.Debug("not caching a token without a token file", "token_path", m.cfg.TokenPath)
+		return
+	}
+	if err := m.writeCache(ttl, minTTL, accessor); err != nil {
+		slog.Warn("error writing cache file", "cache_file", m.cfg.CacheFile, "error", err)
+	}
+}
+
+// Writes the cache file for saveCache.
+func (m *Manager) writeCache(ttl, minTTL time.Duration, accessor string) error {
+	tokenInfo, err := os.Stat(m.cfg.TokenPath)
+	if err != nil {
+		return fmt.Errorf("error accessing token file: %v", err)
+	}
+
+	now := time.Now()
+	data, err := json.Marshal(lookupCache{
+		ExpireTime:   now.Add(ttl),
+		RefreshAt:    now.Add(ttl - minTTL),
+		ReadAt:       now,
+		TokenModTime: tokenInfo.ModTime(),
+		Accessor:     accessor,
+		VaultAddr:    m.client.Address(),
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding cache: %v", err)
+	}
+
+	return os.WriteFile(m.cfg.CacheFile, data, 0600)
+}
@@ -0,0 +1,174 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Runs the `vault login` command until it exits or the login timeouts fire.
+type commandRunner func(cmd *exec.Cmd, cfg Config) error
+
+// Seams around exec, swapped for stubs when testing cliLogin without the
+// vault binary.
+var (
+	lookPath               = exec.LookPath
+	runLogin commandRunner = runWithLoginTimeouts
+)
+
+// Failure of a vault login killed by Config.LoginTimeout, which is not worth
+// retrying since nobody completed it in time.
+var errLoginTimedOut = errors.New("vault login timed out")
+
+// Launches `vault` CLI and performs the login, using the browser for OIDC.
+func (m *Manager) cliLogin(ctx context.Context) error {
+	if m.cfg.Method == MethodJWT {
+		return fmt.Errorf("jwt login needs Config.Native, the vault CLI has no jwt login")
+	}
+	if _, err := lookPath("vault"); err != nil {
+		slog.Debug("vault binary not found", "path", os.Getenv("PATH"))
+		return fmt.Errorf("%w, install it from https://developer.hashicorp.com/vault/install", ErrVaultBinaryMissing)
+	}
+
+	args := []string{"login", "-method=" + m.cfg.Method, "-path=" + m.cfg.MountPath, "-address", m.client.Address()}
+	if m.role != "" {
+		args = append(args, "role="+m.role)
+	}
+	if m.cfg.TokenType != "" {
+		args = append(args, "token_type="+m.cfg.TokenType)
+	}
+	if m.cfg.NumUses > 0 {
+		args = append(args, "num_uses="+strconv.Itoa(m.cfg.NumUses))
+	}
+	if m.cfg.Method == MethodOIDC {
+		for k, v := range m.cfg.OIDCParams {
+			args = append(args, k+"="+v)
+		}
+	}
+	for k, v := range m.cfg.LoginParams {
+		// Kept out of the command line, where other users can read it.
+		if m.cfg.Method == MethodGitHub && k == credentialParams[MethodGitHub] {
+			continue
+		}
+		args = append(args, k+"="+v)
+	}
+
+	cmd := exec.CommandContext(ctx, "vault", args...)
+	// Keep the processes vault login spawns together, so that none of them
+	// outlives a cancelled login. Closing the terminal sends SIGHUP to us
+	// only, which cancels ctx.
+	setProcessGroup(cmd)
+	// On cancellation give vault login the chance to exit gracefully before
+	// it gets killed.
+	cmd.Cancel = func() error {
+		slog.Info("sending SIGTERM to vault login process group")
+		return signalProcessGroup(cmd, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = m.cfg.LoginKillTimeout - m.cfg.LoginTimeout
+	stdout := &lineLogger{stream: "stdout"}
+	stderr := &lineLogger{stream: "stderr"}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Prompts read from the terminal, e.g. the passcode of an MFA login.
+	cmd.Stdin = os.Stdin
+	cmd.Env = os.Environ()
+	if m.cfg.Namespace != "" {
+		cmd.Env = append(cmd.Env, "VAULT_NAMESPACE="+m.cfg.Namespace)
+	}
+	if m.cfg.Proxy != "" {
+		cmd.Env = append(cmd.Env, "HTTPS_PROXY="+m.cfg.Proxy, "HTTP_PROXY="+m.cfg.Proxy)
+	}
+	if m.cfg.SOCKS5 != "" {
+		// The vault CLI ignores ALL_PROXY, but Go honors socks5 URLs in
+		// HTTP(S)_PROXY.
+		cmd.Env = append(cmd.Env, "ALL_PROXY="+m.cfg.SOCKS5, "HTTPS_PROXY="+m.cfg.SOCKS5, "HTTP_PROXY="+m.cfg.SOCKS5)
+	}
+	if m.cfg.ClientCert != "" {
+		cmd.Env = append(cmd.Env, "VAULT_CLIENT_CERT="+m.cfg.ClientCert, "VAULT_CLIENT_KEY="+m.cfg.ClientKey)
+	}
+	for k, v := range m.cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if token, ok := m.cfg.LoginParams[credentialParams[MethodGitHub]]; ok && m.cfg.Method == MethodGitHub {
+		cmd.Env = append(cmd.Env, "VAULT_AUTH_GITHUB_TOKEN="+token)
+	}
+
+	previousToken, _ := m.storedToken(ctx)
+	err := runLogin(cmd, m.cfg)
+	stdout.flush()
+	stderr.flush()
+	if err != nil {
+		// The login may have completed right as the timeout fired.
+		if !m.freshTokenStored(ctx, previousToken) {
+			return err
+		}
+		slog.Warn("vault login failed but stored a new valid token, assuming it succeeded", "error", err)
+	}
+	slog.Info(fmt.Sprintf("logged in using %s successfully", displayMethod(m.cfg.Method)), "role", displayRole(m.role), "action", ActionLoggedIn)
+
+	return nil
+}
+
+// Reports whether a token other than previousToken is now stored, with a TTL
+// above the min TTL.
+func (m *Manager) freshTokenStored(ctx context.Context, previousToken string) bool {
+	token, err := m.storedToken(ctx)
+	if err != nil || token == "" || token == previousToken {
+		return false
+	}
+
+	info, err := m.Lookup(ctx)
+	return err == nil && (info.TTL > m.MinTTL(info) || info.NoExpiry)
+}
+
+// Runs cmd, sending it SIGTERM after Config.LoginTimeout and SIGKILL after
+// Config.LoginKillTimeout.
+func runWithLoginTimeouts(cmd *exec.Cmd, cfg Config) error {
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting vault login: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timedOut atomic.Bool
+	termTimer := time.AfterFunc(cfg.LoginTimeout, func() {
+		timedOut.Store(true)
+		slog.Debug("login timer fired", "timeout", cfg.LoginTimeout.String())
+		slog.Info("sending SIGTERM to vault login process group")
+		if err := signalProcessGroup(cmd, syscall.SIGTERM); err != nil {
+			slog.Error("error sending SIGTERM", "error", err)
+		}
+	})
+
+	killTimer := time.AfterFunc(cfg.LoginKillTimeout, func() {
+		slog.Debug("login kill timer fired", "timeout", cfg.LoginKillTimeout.String())
+		slog.Info("sending SIGKILL to vault login process group")
+		if err := signalProcessGroup(cmd, syscall.SIGKILL); err != nil {
+			slog.Error("error sending SIGKILL", "error", err)
+		}
+	})
+
+	err = <-done
+
+	termTimer.Stop()
+	killTimer.Stop()
+
+	if err != nil && timedOut.Load() {
+		return fmt.Errorf("%w after %v: %w", errLoginTimedOut, cfg.LoginTimeout, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error during %s login: %w", displayMethod(cfg.Method), err)
+	}
+	return nil
+}
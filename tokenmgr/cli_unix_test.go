@@ -0,0 +1,87 @@
+//go:build unix
+
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Stands for vault login, spawning a child that would outlive it if only the
+// vault process was signalled.
+const fakeVaultScript = `#!/bin/sh
+echo $$ > "$PGID_FILE"
+sleep 60 &
+wait
+`
+
+func TestCLILoginCancelKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	vault := filepath.Join(dir, "vault")
+	if err := os.WriteFile(vault, []byte(fakeVaultScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	origLookPath := lookPath
+	lookPath = func(string) (string, error) { return vault, nil }
+	t.Cleanup(func() { lookPath = origLookPath })
+
+	pgidFile := filepath.Join(dir, "pgid")
+	t.Setenv("PGID_FILE", pgidFile)
+	m := newTestManager(t, "", Config{
+		MinTTL:           time.Hour,
+		LoginTimeout:     time.Minute,
+		LoginKillTimeout: 90 * time.Second,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- m.cliLogin(ctx)
+	}()
+
+	var pgid int
+	for deadline := time.Now().Add(5 * time.Second); pgid == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("fake vault login didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if b, err := os.ReadFile(pgidFile); err == nil && strings.HasSuffix(string(b), "\n") {
+			pgid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+	}
+	if err := syscall.Kill(-pgid, 0); err != nil {
+		t.Fatalf("process group %d isn't running: %v", pgid, err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("cliLogin succeeded after ctx was cancelled")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("cliLogin didn't return after ctx was cancelled")
+	}
+
+	// The orphaned sleep may take a moment to be reaped.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		err := syscall.Kill(-pgid, 0)
+		if errors.Is(err, syscall.ESRCH) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process group %d is still running after cancellation: %v", pgid, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,77 @@
+package tokenmgr
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Auth methods Config.Method can be set to.
+const (
+	MethodOIDC   = "oidc"
+	MethodJWT    = "jwt"
+	MethodGitHub = "github"
+)
+
+// Login parameter carrying the credential of the non-interactive methods.
+var credentialParams = map[string]string{
+	MethodJWT:    "jwt",
+	MethodGitHub: "token",
+}
+
+// Logs in with a credential given in Config.LoginParams, through the Vault
+// API, for the auth methods that don't involve a browser.
+func (m *Manager) credentialLogin(ctx context.Context) (*api.Secret, error) {
+	param := credentialParams[m.cfg.Method]
+	data := map[string]interface{}{}
+	for k, v := range m.cfg.LoginParams {
+		data[k] = v
+	}
+	if m.cfg.Method == MethodGitHub && data[param] == nil {
+		// Where the vault CLI looks for it too.
+		if token := os.Getenv("VAULT_AUTH_GITHUB_TOKEN"); token != "" {
+			data[param] = token
+		}
+	}
+	if data[param] == nil {
+		return nil, fmt.Errorf("%s login needs the %s login parameter", m.cfg.Method, param)
+	}
+	if m.role != "" {
+		data["role"] = m.role
+	}
+	if m.cfg.TokenType != "" {
+		data["token_type"] = m.cfg.TokenType
+	}
+	if m.cfg.NumUses > 0 {
+		data["num_uses"] = m.cfg.NumUses
+	}
+
+	secret, err := m.client.Logical().WriteWithContext(ctx, "auth/"+m.cfg.MountPath+"/login", data)
+	if err != nil {
+		return nil, fmt.Errorf("error logging in: %w", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("no auth info in login response")
+	}
+
+	m.client.SetToken(secret.Auth.ClientToken)
+	slog.Info(fmt.Sprintf("logged in using %s successfully", displayMethod(m.cfg.Method)), "role", displayRole(m.role), "action", ActionLoggedIn)
+
+	return secret, nil
+}
+
+// Returns the name of the auth method as it appears in messages.
+func displayMethod(method string) string {
+	switch method {
+	case MethodOIDC:
+		return "OIDC"
+	case MethodJWT:
+		return "JWT"
+	case MethodGitHub:
+		return "GitHub"
+	}
+	return method
+}
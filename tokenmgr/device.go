@@ -0,0 +1,101 @@
+package tokenmgr
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Performs OIDC login through the device authorization flow: the user opens
+// the verification URL on any device and enters the code, while we poll
+// Vault until the login completes. Requires a role with callback_mode=device.
+func (m *Manager) oidcLoginDevice(ctx context.Context) (*api.Secret, error) {
+	clientNonce, err := randomNonce()
+	if err != nil {
+		return nil, fmt.Errorf("error generating client nonce: %v", err)
+	}
+
+	// Vault insists on a redirect_uri even though no callback is involved.
+	redirectURI := m.cfg.RedirectURI
+	if redirectURI == "" {
+		redirectURI = "http://localhost:8250/oidc/callback"
+	}
+	authURLData := map[string]interface{}{
+		"redirect_uri": redirectURI,
+		"client_nonce": clientNonce,
+	}
+	if m.role != "" {
+		authURLData["role"] = m.role
+	}
+	if m.cfg.TokenType != "" {
+		authURLData["token_type"] = m.cfg.TokenType
+	}
+	if m.cfg.NumUses > 0 {
+		authURLData["num_uses"] = m.cfg.NumUses
+	}
+	for k, v := range m.cfg.OIDCParams {
+		authURLData[k] = v
+	}
+
+	authURLSecret, err := m.client.Logical().WriteWithContext(ctx, "auth/"+m.cfg.MountPath+"/oidc/auth_url", authURLData)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting device code: %w", err)
+	}
+	if authURLSecret == nil {
+		return nil, fmt.Errorf("empty response requesting device code")
+	}
+
+	userCode, _ := authURLSecret.Data["user_code"].(string)
+	verificationURI, _ := authURLSecret.Data["verification_uri"].(string)
+	state, _ := authURLSecret.Data["state"].(string)
+	if userCode == "" || verificationURI == "" || state == "" {
+		return nil, fmt.Errorf("no device code in response, check the role uses callback_mode=device")
+	}
+
+	interval := 5 * time.Second
+	if secs, err := parseSeconds(authURLSecret.Data["interval"]); err == nil && secs > 0 {
+		interval = secs
+	}
+
+	fmt.Fprintf(m.cfg.Stdout, "To complete the login, open %s and enter the code %s\n", verificationURI, userCode)
+
+	deadline := time.After(m.cfg.LoginTimeout)
+	for {
+		select {
+		case <-time.After(interval):
+		case <-deadline:
+			return nil, fmt.Errorf("timed out after %v waiting for the device to be authorized", m.cfg.LoginTimeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		secret, err := m.client.Logical().WriteWithContext(ctx, "auth/"+m.cfg.MountPath+"/oidc/poll", map[string]interface{}{
+			"state":        state,
+			"client_nonce": clientNonce,
+		})
+		switch {
+		case err != nil && strings.Contains(err.Error(), "authorization_pending"):
+			slog.Debug("device authorization pending")
+			continue
+		case err != nil && strings.Contains(err.Error(), "slow_down"):
+			interval += 5 * time.Second
+			slog.Debug("device authorization polling too fast, slowing down", "interval", interval.String())
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("error polling device authorization: %w", err)
+		}
+
+		if secret == nil || secret.Auth == nil {
+			return nil, fmt.Errorf("no auth info in poll response")
+		}
+
+		m.client.SetToken(secret.Auth.ClientToken)
+		slog.Info("logged in using OIDC successfully", "role", displayRole(m.role), "action", ActionLoggedIn)
+
+		return secret, nil
+	}
+}
@@ -0,0 +1,29 @@
+package tokenmgr
+
+import "errors"
+
+// Failure modes wrapped by the errors of this tool, to be told apart with
+// errors.Is rather than by their message.
+var (
+	// No token is stored, or Vault rejects it as expired or invalid.
+	ErrNoToken = errors.New("no valid token")
+
+	// Vault couldn't tell whether the token is valid, e.g. because it's
+	// unreachable.
+	ErrLookupFailed = errors.New("token lookup failed")
+
+	// Renewing didn't help and logging in again didn't work either.
+	ErrLoginFailed = errors.New("login failed")
+
+	// A browser login is needed but nobody is there to complete it.
+	ErrNotInteractive = errors.New("interactive login needed but there is no terminal nor display")
+
+	// The token needs a login, which Config.RenewOnly forbids.
+	ErrLoginDisabled = errors.New("token can't be renewed and logins are disabled")
+
+	// The address the callback listener of the native flow needs is taken.
+	ErrCallbackInUse = errors.New("callback address already in use")
+
+	// The vault CLI needed for the non native login isn't installed.
+	ErrVaultBinaryMissing = errors.New("vault CLI not found in PATH")
+)
@@ -0,0 +1,84 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Runs fn against each of Config.Addresses in turn until a Vault server
+// answers, leaving the client set to that address for the following calls.
+func (m *Manager) withFailover(ctx context.Context, fn func() error) error {
+	if len(m.cfg.Addresses) <= 1 {
+		return fn()
+	}
+
+	var err error
+	for _, addr := range m.cfg.Addresses {
+		if setErr := m.client.SetAddress(addr); setErr != nil {
+			return fmt.Errorf("error setting vault address %s: %v", addr, setErr)
+		}
+
+		err = fn()
+		if answered(ctx, err) {
+			slog.Info("selected vault address", "vault_addr", addr)
+			return err
+		}
+		slog.Warn("vault address unusable", "vault_addr", addr, "error", err)
+	}
+	return err
+}
+
+// Reports whether err still means a usable server answered: no error, or a
+// client error like a rejected token. Cancellations aren't worth a failover
+// either.
+func answered(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return true
+	}
+	var respErr *api.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode < http.StatusInternalServerError
+}
+
+// Bounds of the backoff between health checks, short enough to ride out a
+// leader election without holding up the run for long.
+const (
+	healthRetryBaseDelay = time.Second
+	healthRetryMaxDelay  = 10 * time.Second
+)
+
+// Pings the Vault server, failing if it's unreachable or sealed even after
+// Config.HealthRetries retries.
+func (m *Manager) CheckHealth(ctx context.Context) error {
+	delay := healthRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		slog.Debug("checking vault server health", "attempt", attempt, "max_retries", m.cfg.HealthRetries)
+		err := m.withFailover(ctx, func() error {
+			health, err := m.client.Sys().HealthWithContext(ctx)
+			if err != nil {
+				return fmt.Errorf("error reaching vault server: %v", err)
+			}
+			if health.Sealed {
+				return fmt.Errorf("vault server is sealed")
+			}
+			slog.Debug("vault server is healthy", "vault_addr", m.client.Address(), "version", health.Version, "standby", health.Standby)
+			return nil
+		})
+		if err == nil || attempt > m.cfg.HealthRetries {
+			return err
+		}
+
+		slog.Debug("vault server is not usable, retrying", "attempt", attempt, "delay", delay.String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(2*delay, healthRetryMaxDelay)
+	}
+}
@@ -0,0 +1,47 @@
+package tokenmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Formats of the token file, see Config.TokenFormat.
+const (
+	// The bare token, as written by the vault CLI.
+	TokenFormatRaw = "raw"
+
+	// A JSON object holding the token in its token field.
+	TokenFormatJSON = "json"
+)
+
+// Contents of a token file in TokenFormatJSON.
+type jsonTokenFile struct {
+	Token string `json:"token"`
+}
+
+// Returns the token held by the contents of a token file in format.
+func decodeToken(data []byte, format string) (string, error) {
+	if format != TokenFormatJSON || strings.TrimSpace(string(data)) == "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	var f jsonTokenFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", fmt.Errorf("error parsing json token file: %v", err)
+	}
+	return strings.TrimSpace(f.Token), nil
+}
+
+// Returns the contents of a token file holding token in format.
+func encodeToken(token, format string) (string, error) {
+	if format != TokenFormatJSON {
+		return token, nil
+	}
+
+	data, err := json.Marshal(jsonTokenFile{Token: token})
+	if err != nil {
+		return "", fmt.Errorf("error encoding json token file: %v", err)
+	}
+	return string(data) + "\n", nil
+}
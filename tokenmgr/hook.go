@@ -0,0 +1,32 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Wrapped by the error of a failing Config.PostLoginHook, so that callers
+// can tell it apart while the login itself is reported successful.
+var ErrPostLoginHook = errors.New("post-login hook failed")
+
+// Runs the Config.PostLoginHook command through the shell, exposing the new
+// token as VAULT_TOKEN and its TTL in seconds as VAULT_TOKEN_TTL.
+func (m *Manager) runPostLoginHook(ctx context.Context, token string, newTTL time.Duration) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", m.cfg.PostLoginHook)
+	cmd.Stdout = m.cfg.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"VAULT_TOKEN="+token,
+		"VAULT_TOKEN_TTL="+strconv.FormatInt(int64(newTTL.Seconds()), 10),
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %v", ErrPostLoginHook, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package tokenmgr
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/term"
+)
+
+// Reports whether a browser login can be completed: the user sits at a
+// terminal, or a graphical session can show the browser. Runs from cron
+// have neither and would wait for the login timeout in vain.
+func canLoginInteractively(browserCmd string) bool {
+	if term.IsTerminal(int(os.Stdin.Fd())) || term.IsTerminal(int(os.Stdout.Fd())) {
+		return true
+	}
+	if browserCmd != "" {
+		return true
+	}
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		// Launch agents run without a terminal but can open the browser.
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package tokenmgr
+
+import (
+	"context"
+	"time"
+)
+
+// File locking relies on flock, elsewhere logins aren't serialized.
+func lockFile(ctx context.Context, path string, timeout time.Duration) (unlock func(), waited bool, err error) {
+	return func() {}, false, nil
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Takes an exclusive lock on the file at path, waiting up to timeout for
+// another process to release it. Reports whether it had to wait.
+func lockFile(ctx context.Context, path string, timeout time.Duration) (unlock func(), waited bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, fmt.Errorf("error creating lock file directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening lock file: %v", err)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, waited, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, false, fmt.Errorf("error locking %s: %v", path, err)
+		}
+
+		waited = true
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline:
+			f.Close()
+			return nil, true, fmt.Errorf("timed out after %v waiting for the lock on %s", timeout, path)
+		case <-ctx.Done():
+			f.Close()
+			return nil, true, ctx.Err()
+		}
+	}
+}
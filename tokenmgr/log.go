@@ -0,0 +1,80 @@
+package tokenmgr
+
+import (
+	"bytes"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attributes describing a token TTL, both human readable and in seconds.
+func ttlAttr(d time.Duration) slog.Attr {
+	return slog.Group("",
+		slog.String("ttl", d.String()),
+		slog.Int64("ttl_seconds", int64(d.Seconds())),
+	)
+}
+
+// Vault tokens, such as those vault login prints once logged in.
+var tokenPattern = regexp.MustCompile(`\b(hv[sbr]|[sbr])\.[A-Za-z0-9_-]{20,}`)
+
+// How long a partial line waits for the rest of it before being logged, so
+// that prompts not ending with a newline still show up.
+const partialLineDelay = 200 * time.Millisecond
+
+// Writer logging each line a command writes to it, so that the output of
+// vault login comes in order with our logs instead of interleaving with
+// them. Tokens are redacted.
+type lineLogger struct {
+	stream string
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	if len(l.buf) > 0 {
+		l.timer = time.AfterFunc(partialLineDelay, l.flush)
+	}
+	return len(p), nil
+}
+
+// Logs what is left without a trailing newline, once the command exited or
+// stopped writing for partialLineDelay.
+func (l *lineLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.log(string(l.buf))
+	l.buf = nil
+}
+
+func (l *lineLogger) log(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	slog.Info("vault login output", "stream", l.stream, "output", tokenPattern.ReplaceAllString(line, "[redacted]"))
+}
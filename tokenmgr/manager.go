@@ -0,0 +1,588 @@
+// Package tokenmgr keeps a Vault token obtained through OIDC fresh, renewing
+// it or logging in again when its TTL runs low.
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// What a check did about the token.
+type Action string
+
+const (
+	ActionSkipped  Action = "skipped"
+	ActionRenewed  Action = "renewed"
+	ActionLoggedIn Action = "logged_in"
+
+	// Reported with Config.DryRun instead of renewing or logging in.
+	ActionWouldLogin Action = "would_login"
+)
+
+// Settings of a Manager. The zero value of each field disables the feature
+// it controls, except where noted.
+type Config struct {
+	// Path of the token file, read to find the current token and written
+	// after a native login. StdinTokenPath reads the token from stdin
+	// instead, which only works for checks that never login.
+	TokenPath string
+
+	// Format of the token file, TokenFormatRaw if empty. The vault CLI only
+	// writes raw token files, so TokenFormatJSON needs Native to login.
+	TokenFormat string
+
+	// Login again when the TTL drops below MinTTL, or below MinTTLPercent of
+	// the token's creation TTL when that is set.
+	MinTTL        time.Duration
+	MinTTLPercent float64
+
+	// Login through the Vault API instead of the vault CLI, with the device
+	// flow when Headless is set.
+	Native   bool
+	Headless bool
+
+	// Auth method to login with, MethodOIDC if empty. The other methods
+	// read their credential from LoginParams, and MethodJWT needs Native.
+	Method string
+
+	// Extra key=value parameters of the login, e.g. jwt=<token> for
+	// MethodJWT.
+	LoginParams map[string]string
+
+	// Path where the auth method is mounted, Method if empty.
+	MountPath string
+	Role      string
+	Namespace string
+
+	// Roles tried in turn when logging in with Role fails, e.g. while it's
+	// disabled for maintenance.
+	FallbackRoles []string
+
+	// Time to complete a login before the vault CLI gets SIGTERM, and
+	// before it gets SIGKILL. Default to 1m, and to 30s after LoginTimeout.
+	LoginTimeout     time.Duration
+	LoginKillTimeout time.Duration
+
+	CallbackPort int
+
+	// IP address the callback listener of the native flow binds to and the
+	// redirect URI points to, 127.0.0.1 if empty.
+	CallbackAddr string
+
+	// Keep the callback server of the native flow running between logins,
+	// on the same port and redirect URI, until Close is called.
+	KeepCallbackServer bool
+
+	// First and last ports tried in turn for the callback listener of the
+	// native flow, instead of CallbackPort. Unused when zero.
+	CallbackPortRange [2]int
+	BrowserCmd        string
+
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+
+	// Number of times CheckHealth retries before reporting the server
+	// unusable.
+	HealthRetries int
+
+	// Difference between the TTL computed locally and the one computed by
+	// Vault above which Vault's is used. Defaults to 30s.
+	ClockSkewTolerance time.Duration
+
+	Notify bool
+
+	WebhookURL     string
+	WebhookTimeout time.Duration
+
+	DryRun bool
+
+	// Path of the vault CLI token helper, used instead of TokenPath when set.
+	TokenHelper string
+
+	Proxy string
+
+	// URL of the SOCKS5 proxy the vault CLI reaches Vault through, e.g.
+	// socks5://localhost:1080. The client given to New must already dial
+	// through it.
+	SOCKS5 string
+
+	AbortOnLookupError bool
+
+	PostLoginHook string
+
+	// Login even when the token is still valid, e.g. to pick up new
+	// policies.
+	Force bool
+
+	// Never login, failing with ErrLoginDisabled when the token can't be
+	// renewed instead.
+	RenewOnly bool
+
+	// Policies the token must have, a login is performed when any is
+	// missing.
+	RequirePolicies []string
+
+	// Vault addresses tried in order until one answers, the address of the
+	// client alone if empty.
+	Addresses []string
+
+	// File locked around renewals and logins, so that concurrent runs don't
+	// all login at once. Runs wait for the lock as long as a login can take
+	// with every retry and fallback role. Locking is disabled if empty.
+	LockFile string
+
+	// Client certificate and key presented by the vault CLI, the API client
+	// is expected to be set up with them already.
+	ClientCert string
+	ClientKey  string
+
+	// TTL asked for the token instead of the role's default. OIDC logins
+	// can't ask for a TTL, so the new token is renewed for RequestTTL right
+	// away, and so are renewals.
+	RequestTTL time.Duration
+
+	// Extra parameters of the OIDC authorization request, e.g. acr_values.
+	OIDCParams map[string]string
+
+	// Type of token to ask for at login, service or batch. Empty leaves it
+	// to the role.
+	TokenType string
+
+	// Number of uses to ask for at login, 0 leaves it to the role. Must be
+	// above FewUses, as checks spend uses too: the lookup after a login,
+	// the renewal to RequestTTL and every later lookup. Disables
+	// CacheFile, which would hide how many uses are left.
+	NumUses int
+
+	// File caching the last lookup, so that checks skip asking Vault while
+	// the token file is unchanged and the cached TTL is above min TTL.
+	CacheFile string
+
+	// Shortest time between two logins, which are skipped until it elapses.
+	MinLoginInterval time.Duration
+
+	// Redirect URI of the native flow, listened on instead of a localhost
+	// URI on CallbackPort. Must be on a loopback address, with a port.
+	RedirectURI string
+
+	// Extra environment variables of the vault login process, overriding
+	// the inherited ones.
+	Env map[string]string
+
+	// Template of the line logged after a successful login, executed with
+	// SuccessMessageData, instead of the default one.
+	SuccessMessage *template.Template
+
+	// Writer receiving the data of every token lookup as indented JSON, with
+	// the token itself redacted, to debug TTL issues.
+	DumpLookup io.Writer
+
+	// Where instructions for the user and the output of the commands run go,
+	// os.Stdout if nil.
+	Stdout io.Writer
+}
+
+// Outcome of a single check.
+type Result struct {
+	Action Action
+	TTL    time.Duration
+
+	// Accessor of the token, never the token itself.
+	Accessor string
+
+	// Warnings Vault returned with the token lookup or the login.
+	Warnings []string
+}
+
+// Keeps the token of a Vault client fresh.
+type Manager struct {
+	client *api.Client
+	cfg    Config
+
+	// Callback server of the native flow, when kept across logins.
+	callbacksMu sync.Mutex
+	callbacks   *callbackServer
+
+	// Time of the last successful login, zero before the first.
+	lastLogin time.Time
+
+	// Role of the login in progress, or of the last one.
+	role string
+
+	// Token read from stdin, which can only be read once.
+	stdinOnce  sync.Once
+	stdinToken string
+	stdinErr   error
+}
+
+// Defaults of Config.LoginTimeout, Config.LoginKillTimeout and
+// Config.ClockSkewTolerance.
+const (
+	defaultLoginTimeout       = time.Minute
+	defaultLoginKillTimeout   = 90 * time.Second
+	defaultClockSkewTolerance = 30 * time.Second
+)
+
+// Returns a Manager refreshing the token of client.
+func New(client *api.Client, cfg Config) *Manager {
+	if cfg.Method == "" {
+		cfg.Method = MethodOIDC
+	}
+	cfg.MountPath = strings.Trim(cfg.MountPath, "/")
+	if cfg.MountPath == "" {
+		cfg.MountPath = cfg.Method
+	}
+	if cfg.Stdout == nil {
+		cfg.Stdout = os.Stdout
+	}
+	if cfg.LoginTimeout == 0 {
+		cfg.LoginTimeout = defaultLoginTimeout
+	}
+	if cfg.LoginKillTimeout == 0 {
+		cfg.LoginKillTimeout = cfg.LoginTimeout + defaultLoginKillTimeout - defaultLoginTimeout
+	}
+	if cfg.ClockSkewTolerance == 0 {
+		cfg.ClockSkewTolerance = defaultClockSkewTolerance
+	}
+	return &Manager{client: client, cfg: cfg, role: cfg.Role}
+}
+
+// Returns the TTL of the current token, 0 if there is none.
+func (m *Manager) CurrentTTL(ctx context.Context) (time.Duration, error) {
+	info, err := m.Lookup(ctx)
+	return info.TTL, err
+}
+
+// Renews the token or logs in again if it needs to, returning what was done.
+func (m *Manager) EnsureLoggedIn(ctx context.Context) (Action, error) {
+	res, err := m.Check(ctx)
+	return res.Action, err
+}
+
+// Releases what the Manager keeps running, like the callback server of
+// Config.KeepCallbackServer.
+func (m *Manager) Close() {
+	m.callbacksMu.Lock()
+	defer m.callbacksMu.Unlock()
+	if m.callbacks != nil {
+		m.callbacks.close()
+		m.callbacks = nil
+	}
+}
+
+// Returns the address of the Vault server in use, which changes on failover.
+func (m *Manager) Address() string {
+	return m.client.Address()
+}
+
+// Returns the TTL below which the token must be refreshed.
+func (m *Manager) MinTTL(info TokenInfo) time.Duration {
+	if m.cfg.MinTTLPercent > 0 {
+		return time.Duration(float64(info.CreationTTL) * m.cfg.MinTTLPercent / 100)
+	}
+	return m.cfg.MinTTL
+}
+
+// Checks the token TTL and performs OIDC login if it is below the min TTL.
+func (m *Manager) Check(ctx context.Context) (Result, error) {
+	return m.check(ctx, m.cfg.Force, true)
+}
+
+// Checks the token like Check, but always asks Vault rather than trusting
+// Config.CacheFile, e.g. because the token may have been revoked.
+func (m *Manager) Recheck(ctx context.Context) (Result, error) {
+	return m.check(ctx, m.cfg.Force, false)
+}
+
+// Logs in again whatever the TTL of the token.
+func (m *Manager) Relogin(ctx context.Context) (Result, error) {
+	return m.check(ctx, true, false)
+}
+
+func (m *Manager) check(ctx context.Context, force, useCache bool) (Result, error) {
+	// Policies can't be told from the cache.
+	if m.cfg.CacheFile != "" && useCache && !force && len(m.cfg.RequirePolicies) == 0 {
+		if res, ok := m.cachedCheck(); ok {
+			return res, nil
+		}
+	}
+
+	info, err := m.Lookup(ctx)
+	if err != nil && !errors.Is(err, ErrNoToken) {
+		if m.cfg.AbortOnLookupError {
+			return Result{}, err
+		}
+		slog.Error("error looking up token, assuming a login is needed", "token_path", m.cfg.TokenPath, "error", err)
+	}
+	currTTL := info.TTL
+	minTTL := m.MinTTL(info)
+	tokenTTLSeconds.Set(currTTL.Seconds())
+	missingPolicies := info.missingPolicies(m.cfg.RequirePolicies)
+	fewUses := info.fewUsesLeft()
+	if fewUses {
+		slog.Warn("token has few uses left, login needed", "num_uses", info.NumUses, "token_path", m.cfg.TokenPath)
+	}
+	if info.CreationTTL > 0 && minTTL >= info.CreationTTL {
+		slog.Warn("min ttl is not below the ttl tokens are issued with, every run will login", "min_ttl", minTTL.String(), "creation_ttl", info.CreationTTL.String())
+	}
+	if (currTTL > minTTL || info.NoExpiry) && !force && len(missingPolicies) == 0 && !fewUses {
+		slog.Info("token ttl is not expiring soon", ttlAttr(currTTL), "token_path", m.cfg.TokenPath, "action", ActionSkipped)
+		if !info.NoExpiry {
+			m.saveCache(currTTL, minTTL, info.Accessor)
+		}
+		return Result{Action: ActionSkipped, TTL: currTTL, Accessor: info.Accessor, Warnings: info.Warnings}, nil
+	}
+
+	if m.cfg.DryRun {
+		slog.Info(fmt.Sprintf("would perform %s login (ttl %v below min %v)", displayMethod(m.cfg.Method), currTTL, minTTL), ttlAttr(currTTL), "token_path", m.cfg.TokenPath, "action", ActionWouldLogin)
+		return Result{Action: ActionWouldLogin, TTL: currTTL, Accessor: info.Accessor, Warnings: info.Warnings}, nil
+	}
+
+	if m.cfg.LockFile != "" {
+		unlock, waited, err := lockFile(ctx, m.cfg.LockFile, m.loginBudget())
+		if err != nil {
+			return Result{}, err
+		}
+		defer unlock()
+
+		// Whoever held the lock has most likely refreshed the token already.
+		if waited {
+			slog.Info("waited for another process refreshing the token, checking it again", "lock_file", m.cfg.LockFile)
+			info, err = m.Lookup(ctx)
+			if err != nil && !errors.Is(err, ErrNoToken) {
+				if m.cfg.AbortOnLookupError {
+					return Result{}, err
+				}
+				slog.Error("error looking up token, assuming a login is needed", "token_path", m.cfg.TokenPath, "error", err)
+			}
+			currTTL = info.TTL
+			minTTL = m.MinTTL(info)
+			tokenTTLSeconds.Set(currTTL.Seconds())
+			missingPolicies = info.missingPolicies(m.cfg.RequirePolicies)
+			fewUses = info.fewUsesLeft()
+			if (currTTL > minTTL || info.NoExpiry) && !force && len(missingPolicies) == 0 && !fewUses {
+				slog.Info("token was refreshed by another process", ttlAttr(currTTL), "token_path", m.cfg.TokenPath, "action", ActionSkipped)
+				return Result{Action: ActionSkipped, TTL: currTTL, Accessor: info.Accessor, Warnings: info.Warnings}, nil
+			}
+		}
+	}
+
+	// Renewing keeps the policies and uses of the token, only a login
+	// refreshes them.
+	if force {
+		slog.Info("login forced, logging in again", ttlAttr(currTTL), "token_path", m.cfg.TokenPath)
+	} else if fewUses {
+		slog.Info("renewing doesn't restore the uses of the token, logging in again", "token_path", m.cfg.TokenPath)
+	} else if currTTL > minTTL || info.NoExpiry {
+		slog.Info("token lacks required policies, logging in again", "missing_policies", strings.Join(missingPolicies, ","), "token_path", m.cfg.TokenPath)
+	} else if info.Type == tokenTypeBatch {
+		slog.Info("batch tokens cannot be renewed, logging in again", "token_path", m.cfg.TokenPath)
+	} else if !info.MaxExpiry.IsZero() && time.Until(info.MaxExpiry) <= minTTL {
+		// Renewing can't push the TTL past the max TTL, so not above minTTL.
+		slog.Info("token reached its maximum lifetime, logging in again", "max_expiry", info.MaxExpiry.Format(time.RFC3339), "token_path", m.cfg.TokenPath)
+	} else if info.Renewable {
+		newTTL, err := renew(ctx, m.client, m.cfg.RequestTTL)
+		var respErr *api.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+			// The token expired or was revoked since the lookup, which a
+			// login fixes.
+			slog.Info("token can no longer be renewed, login needed", "token_path", m.cfg.TokenPath, "error", err)
+		} else if err != nil {
+			slog.Warn("renewal failed, falling back to login", "error", err)
+		} else if newTTL <= minTTL {
+			slog.Warn("renewed token ttl is still below min ttl, falling back to login", ttlAttr(newTTL), "min_ttl", minTTL.String())
+		} else {
+			slog.Info("renewed token", ttlAttr(newTTL), "token_path", m.cfg.TokenPath, "action", ActionRenewed)
+			tokenTTLSeconds.Set(newTTL.Seconds())
+			m.saveCache(newTTL, minTTL, info.Accessor)
+			return Result{Action: ActionRenewed, TTL: newTTL, Accessor: info.Accessor, Warnings: info.Warnings}, nil
+		}
+	}
+
+	if m.cfg.RenewOnly {
+		return Result{TTL: currTTL, Accessor: info.Accessor, Warnings: info.Warnings}, ErrLoginDisabled
+	}
+
+	// A role issuing tokens below minTTL would have us login in a loop.
+	if since := time.Since(m.lastLogin); !m.lastLogin.IsZero() && since < m.cfg.MinLoginInterval {
+		slog.Warn("not logging in again this soon after the last login, check that the OIDC role ttl is above min ttl", "last_login", since.Round(time.Second).String(), "min_login_interval", m.cfg.MinLoginInterval.String(), ttlAttr(currTTL), "action", ActionSkipped)
+		return Result{Action: ActionSkipped, TTL: currTTL, Accessor: info.Accessor, Warnings: info.Warnings}, nil
+	}
+
+	newInfo, err := m.login(ctx)
+	if err != nil {
+		loginsFailed.Inc()
+		return Result{}, fmt.Errorf("%w: %w", ErrLoginFailed, err)
+	}
+	m.lastLogin = time.Now()
+	if m.cfg.RequestTTL > 0 {
+		newInfo.TTL = m.requestTTL(ctx, newInfo)
+	}
+	newTTL := newInfo.TTL
+	loginsSucceeded.Inc()
+	tokenTTLSeconds.Set(newTTL.Seconds())
+
+	if missing := newInfo.missingPolicies(m.cfg.RequirePolicies); len(missing) > 0 {
+		slog.Warn("new token still lacks required policies, check the OIDC role", "missing_policies", strings.Join(missing, ","))
+	}
+	if m.cfg.TokenType != "" && newInfo.Type != "" && newInfo.Type != m.cfg.TokenType {
+		slog.Warn("vault issued a token of another type than requested, check the OIDC role", "token_type", newInfo.Type, "requested_token_type", m.cfg.TokenType)
+	}
+
+	m.logSuccess(newInfo)
+	if m.cfg.Notify {
+		notifyLogin(newTTL)
+	}
+	if m.cfg.WebhookURL != "" {
+		m.postLoginWebhook(ctx, newTTL)
+	}
+
+	if newTTL > m.MinTTL(newInfo) {
+		m.saveCache(newTTL, m.MinTTL(newInfo), newInfo.Accessor)
+	}
+
+	res := Result{Action: ActionLoggedIn, TTL: newTTL, Accessor: newInfo.Accessor, Warnings: newInfo.Warnings}
+	if m.cfg.PostLoginHook != "" {
+		if err := m.runPostLoginHook(ctx, m.client.Token(), newTTL); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// Returns how long a login can take at most, with every retry of every role,
+// which is how long to wait for another process logging in.
+func (m *Manager) loginBudget() time.Duration {
+	attempts := time.Duration(m.cfg.MaxRetries + 1)
+	backoff := m.cfg.RetryBaseDelay * (1<<m.cfg.MaxRetries - 1)
+	roles := time.Duration(1 + len(m.cfg.FallbackRoles))
+	return roles * (attempts*m.cfg.LoginKillTimeout + backoff)
+}
+
+// Logs in with the configured method, trying Config.Role then each of
+// Config.FallbackRoles until one works, returning what is known of the new
+// token.
+func (m *Manager) login(ctx context.Context) (TokenInfo, error) {
+	loginsAttempted.Inc()
+
+	if m.cfg.Method == MethodOIDC && !m.cfg.Headless && !canLoginInteractively(m.cfg.BrowserCmd) {
+		return TokenInfo{}, ErrNotInteractive
+	}
+
+	roles := append([]string{m.cfg.Role}, m.cfg.FallbackRoles...)
+	var errs []any
+	for i, role := range roles {
+		m.role = role
+		info, err := m.loginWithRole(ctx)
+		if err == nil {
+			if i > 0 {
+				slog.Info("logged in with a fallback role", "role", displayRole(role), "failed_roles", i)
+			}
+			return info, nil
+		}
+		if len(roles) == 1 {
+			return TokenInfo{}, err
+		}
+		errs = append(errs, fmt.Errorf("role %s: %w", displayRole(role), err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(roles)-1 {
+			slog.Warn("login failed, trying the next role", "role", displayRole(role), "next_role", displayRole(roles[i+1]), "error", err)
+		}
+	}
+	// On one line, unlike errors.Join.
+	format := strings.TrimSuffix(strings.Repeat("%w; ", len(errs)), "; ")
+	return TokenInfo{}, fmt.Errorf("%d of %d roles failed: "+format, append([]any{len(errs), len(roles)}, errs...)...)
+}
+
+// Logs in with the configured method and the role in m.role.
+func (m *Manager) loginWithRole(ctx context.Context) (TokenInfo, error) {
+	if m.cfg.Native {
+		var secret *api.Secret
+		err := m.withRetry(ctx, func() (err error) {
+			if m.cfg.Method == MethodOIDC {
+				secret, err = m.oidcLoginNative(ctx)
+			} else {
+				secret, err = m.credentialLogin(ctx)
+			}
+			return err
+		})
+		if err != nil {
+			return TokenInfo{}, err
+		}
+
+		if m.cfg.TokenHelper != "" {
+			if err := tokenHelperStore(ctx, m.cfg.TokenHelper, secret.Auth.ClientToken); err != nil {
+				return TokenInfo{}, err
+			}
+		} else if err := writeToken(m.cfg.TokenPath, secret.Auth.ClientToken, m.cfg.TokenFormat); err != nil {
+			return TokenInfo{}, err
+		}
+
+		return tokenInfoFromAuth(secret)
+	}
+
+	err := m.withRetry(ctx, func() error {
+		return m.cliLogin(ctx)
+	})
+	if err != nil {
+		return TokenInfo{}, err
+	}
+
+	// The vault CLI stores the token through the helper itself.
+	if m.cfg.TokenHelper == "" {
+		if err := secureTokenFile(m.cfg.TokenPath); err != nil {
+			return TokenInfo{}, err
+		}
+	}
+
+	// The vault CLI doesn't hand the login response over, look the new token
+	// up instead.
+	info, err := m.Lookup(ctx)
+	if err != nil {
+		slog.Error("error looking up the new token", "token_path", m.cfg.TokenPath, "error", err)
+	}
+	return info, nil
+}
+
+// Renews the new token for Config.RequestTTL, returning its resulting TTL.
+// Vault clamps the TTL to the max TTL of the role.
+func (m *Manager) requestTTL(ctx context.Context, info TokenInfo) time.Duration {
+	if !info.Renewable {
+		slog.Warn("new token is not renewable, keeping the ttl granted at login", ttlAttr(info.TTL), "request_ttl", m.cfg.RequestTTL.String())
+		return info.TTL
+	}
+
+	newTTL, err := renew(ctx, m.client, m.cfg.RequestTTL)
+	if err != nil {
+		slog.Warn("error requesting ttl, keeping the ttl granted at login", ttlAttr(info.TTL), "request_ttl", m.cfg.RequestTTL.String(), "error", err)
+		return info.TTL
+	}
+
+	if newTTL < m.cfg.RequestTTL {
+		slog.Warn("vault clamped the requested ttl to the max ttl", ttlAttr(newTTL), "request_ttl", m.cfg.RequestTTL.String())
+	} else {
+		slog.Info("vault granted the requested ttl", ttlAttr(newTTL), "request_ttl", m.cfg.RequestTTL.String())
+	}
+	return newTTL
+}
+
+// Returns the role name to show in logs.
+func displayRole(role string) string {
+	if role == "" {
+		return "<default>"
+	}
+	return role
+}
@@ -0,0 +1,42 @@
+package tokenmgr
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Fields available to Config.SuccessMessage.
+type SuccessMessageData struct {
+	TTL        time.Duration
+	TTLSeconds int64
+	Accessor   string
+	VaultAddr  string
+	TokenPath  string
+	Role       string
+}
+
+// Logs the line announcing a successful login, rendered from
+// Config.SuccessMessage when set.
+func (m *Manager) logSuccess(info TokenInfo) {
+	if m.cfg.SuccessMessage == nil {
+		slog.Info("current token ttl is now", ttlAttr(info.TTL), "token_path", m.cfg.TokenPath, "accessor", info.Accessor, "action", ActionLoggedIn)
+		return
+	}
+
+	var msg strings.Builder
+	err := m.cfg.SuccessMessage.Execute(&msg, SuccessMessageData{
+		TTL:        info.TTL,
+		TTLSeconds: int64(info.TTL.Seconds()),
+		Accessor:   info.Accessor,
+		VaultAddr:  m.client.Address(),
+		TokenPath:  m.cfg.TokenPath,
+		Role:       displayRole(m.role),
+	})
+	if err != nil {
+		slog.Warn("error rendering success message", "error", err)
+		slog.Info("current token ttl is now", ttlAttr(info.TTL), "token_path", m.cfg.TokenPath, "accessor", info.Accessor, "action", ActionLoggedIn)
+		return
+	}
+	slog.Info(msg.String(), "action", ActionLoggedIn)
+}
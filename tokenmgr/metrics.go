@@ -0,0 +1,27 @@
+package tokenmgr
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics registered with the default registry, exposed by the CLI with
+// --metrics-addr.
+var (
+	loginsAttempted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vault_periodic_oidc_login_logins_attempted_total",
+		Help: "Number of OIDC logins attempted.",
+	})
+	loginsSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vault_periodic_oidc_login_logins_succeeded_total",
+		Help: "Number of OIDC logins that succeeded.",
+	})
+	loginsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vault_periodic_oidc_login_logins_failed_total",
+		Help: "Number of OIDC logins that failed.",
+	})
+	tokenTTLSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vault_periodic_oidc_login_token_ttl_seconds",
+		Help: "Remaining TTL of the token at the last check.",
+	})
+)
@@ -0,0 +1,344 @@
+package tokenmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Address the callback listener binds to unless Config.CallbackAddr is set.
+const defaultCallbackAddr = "127.0.0.1"
+
+// Result of the OIDC provider redirecting the browser to the callback listener.
+type oidcCallback struct {
+	state string
+	code  string
+	err   error
+}
+
+// Performs OIDC login through the Vault API, without relying on the `vault` CLI.
+func (m *Manager) oidcLoginNative(ctx context.Context) (*api.Secret, error) {
+	if m.cfg.Headless {
+		return m.oidcLoginDevice(ctx)
+	}
+
+	callbacks, err := m.callbackServer()
+	if err != nil {
+		return nil, err
+	}
+	if !m.cfg.KeepCallbackServer {
+		defer callbacks.close()
+	}
+	redirectURI := callbacks.redirectURI
+
+	clientNonce, err := randomNonce()
+	if err != nil {
+		return nil, fmt.Errorf("error generating client nonce: %v", err)
+	}
+
+	authURLData := map[string]interface{}{
+		"redirect_uri": redirectURI,
+		"client_nonce": clientNonce,
+	}
+	if m.role != "" {
+		authURLData["role"] = m.role
+	}
+	if m.cfg.TokenType != "" {
+		authURLData["token_type"] = m.cfg.TokenType
+	}
+	if m.cfg.NumUses > 0 {
+		authURLData["num_uses"] = m.cfg.NumUses
+	}
+	for k, v := range m.cfg.OIDCParams {
+		authURLData[k] = v
+	}
+
+	authURLSecret, err := m.client.Logical().WriteWithContext(ctx, "auth/"+m.cfg.MountPath+"/oidc/auth_url", authURLData)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting auth url: %w", err)
+	}
+	if authURLSecret == nil {
+		return nil, fmt.Errorf("empty response requesting auth url")
+	}
+
+	authURL, ok := authURLSecret.Data["auth_url"].(string)
+	if !ok || authURL == "" {
+		return nil, fmt.Errorf("auth_url not found in response, check the role's allowed_redirect_uris")
+	}
+
+	// The state ties the callback to this login, should another one be
+	// using the same callback server.
+	parsedAuthURL, err := url.Parse(authURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing auth url: %v", err)
+	}
+	state := parsedAuthURL.Query().Get("state")
+	if state == "" {
+		return nil, fmt.Errorf("no state in auth url")
+	}
+	callback, forget := callbacks.expect(state)
+	defer forget()
+
+	slog.Info("complete the login via your OIDC provider", "auth_url", authURL)
+	printURL := func() {
+		fmt.Fprintf(m.cfg.Stdout, "Open this URL in your browser to complete the login:\n\n    %s\n\n", authURL)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	err = openBrowser(m.cfg.BrowserCmd, authURL, func(err error) {
+		select {
+		case <-done:
+			// The login is over already.
+		default:
+			slog.Warn("browser command failed", "error", err)
+			printURL()
+		}
+	})
+	if err != nil {
+		slog.Warn("error opening browser", "error", err)
+		printURL()
+	}
+
+	var cb oidcCallback
+	select {
+	case cb = <-callback:
+	case <-time.After(m.cfg.LoginTimeout):
+		return nil, fmt.Errorf("timed out after %v waiting for the OIDC callback", m.cfg.LoginTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if cb.err != nil {
+		return nil, cb.err
+	}
+
+	secret, err := m.client.Logical().ReadWithDataWithContext(ctx, "auth/"+m.cfg.MountPath+"/oidc/callback", map[string][]string{
+		"state":        {cb.state},
+		"code":         {cb.code},
+		"client_nonce": {clientNonce},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %w", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("no auth info in callback response")
+	}
+
+	m.client.SetToken(secret.Auth.ClientToken)
+	slog.Info("logged in using OIDC successfully", "role", displayRole(m.role), "action", ActionLoggedIn)
+
+	return secret, nil
+}
+
+// Listener of the native flow receiving the redirects of the OIDC provider,
+// handing each one to the login waiting for its state.
+type callbackServer struct {
+	server      *http.Server
+	redirectURI string
+
+	mu      sync.Mutex
+	pending map[string]chan oidcCallback
+}
+
+// Returns the callback server kept for the lifetime of the Manager when
+// Config.KeepCallbackServer is set, or a new one to close after the login.
+func (m *Manager) callbackServer() (*callbackServer, error) {
+	if !m.cfg.KeepCallbackServer {
+		return m.startCallbackServer()
+	}
+
+	m.callbacksMu.Lock()
+	defer m.callbacksMu.Unlock()
+	if m.callbacks == nil {
+		callbacks, err := m.startCallbackServer()
+		if err != nil {
+			return nil, err
+		}
+		m.callbacks = callbacks
+	}
+	return m.callbacks, nil
+}
+
+// Starts a callback server on the configured redirect URI, port or port
+// range.
+func (m *Manager) startCallbackServer() (*callbackServer, error) {
+	callbackAddr := m.cfg.CallbackAddr
+	if callbackAddr == "" {
+		callbackAddr = defaultCallbackAddr
+	}
+	listenAddr := net.JoinHostPort(callbackAddr, strconv.Itoa(m.cfg.CallbackPort))
+	callbackPath := "/oidc/callback"
+	if m.cfg.RedirectURI != "" {
+		u, err := url.Parse(m.cfg.RedirectURI)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing redirect uri: %v", err)
+		}
+		listenAddr = u.Host
+		if u.Hostname() == "localhost" {
+			listenAddr = net.JoinHostPort("127.0.0.1", u.Port())
+		}
+		callbackPath = u.Path
+	}
+
+	listener, err := m.listenCallback(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &callbackServer{
+		redirectURI: m.cfg.RedirectURI,
+		pending:     map[string]chan oidcCallback{},
+	}
+	if s.redirectURI == "" {
+		// Roles usually allow localhost in their redirect URIs, which is
+		// where the default address is found.
+		redirectHost := callbackAddr
+		if callbackAddr == defaultCallbackAddr {
+			redirectHost = "localhost"
+		}
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		s.redirectURI = "http://" + net.JoinHostPort(redirectHost, port) + "/oidc/callback"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, s.handle)
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(listener)
+
+	return s, nil
+}
+
+// Hands the redirect over to the login waiting for its state.
+func (s *callbackServer) handle(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cb := oidcCallback{state: query.Get("state"), code: query.Get("code")}
+	if errCode := query.Get("error"); errCode != "" {
+		cb.err = fmt.Errorf("provider returned an error: %s: %s", errCode, query.Get("error_description"))
+	}
+
+	s.mu.Lock()
+	callback, ok := s.pending[cb.state]
+	delete(s.pending, cb.state)
+	s.mu.Unlock()
+	if !ok {
+		slog.Warn("received OIDC callback for an unknown or finished login")
+		http.Error(w, "Unknown or expired Vault login, start it again.", http.StatusBadRequest)
+		return
+	}
+
+	if cb.err != nil {
+		fmt.Fprintln(w, "Vault login failed, you can close this window.")
+	} else {
+		fmt.Fprintln(w, "Vault login succeeded, you can close this window.")
+	}
+	callback <- cb
+}
+
+// Returns the channel receiving the callback of state, and the function to
+// call once it is no longer awaited.
+func (s *callbackServer) expect(state string) (<-chan oidcCallback, func()) {
+	callback := make(chan oidcCallback, 1)
+	s.mu.Lock()
+	s.pending[state] = callback
+	s.mu.Unlock()
+
+	return callback, func() {
+		s.mu.Lock()
+		delete(s.pending, state)
+		s.mu.Unlock()
+	}
+}
+
+// Stops the callback server.
+func (s *callbackServer) close() {
+	s.server.Close()
+}
+
+// Starts the callback listener on listenAddr, or on the first free port of
+// Config.CallbackPortRange when set.
+func (m *Manager) listenCallback(listenAddr string) (net.Listener, error) {
+	first, last := m.cfg.CallbackPortRange[0], m.cfg.CallbackPortRange[1]
+	if first == 0 {
+		listener, err := net.Listen("tcp", listenAddr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("%w: %s", ErrCallbackInUse, listenAddr)
+		} else if err != nil {
+			return nil, fmt.Errorf("error starting callback listener: %v", err)
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting callback listener: %v", err)
+	}
+	for port := first; port <= last; port++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if errors.Is(err, syscall.EADDRINUSE) {
+			slog.Debug("callback port in use, trying the next one", "callback_port", port)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error starting callback listener: %v", err)
+		}
+		return listener, nil
+	}
+	return nil, fmt.Errorf("%w: every port from %d to %d", ErrCallbackInUse, first, last)
+}
+
+// Opens url with browserCmd, or with the platform's default browser if
+// browserCmd is empty. A %s in browserCmd is replaced by the url, otherwise
+// the url is passed as the last argument. failed is called from another
+// goroutine if the command exits with an error.
+func openBrowser(browserCmd, url string, failed func(error)) error {
+	var cmd *exec.Cmd
+	switch args := strings.Fields(browserCmd); {
+	case len(args) > 0:
+		if strings.Contains(browserCmd, "%s") {
+			for i := range args {
+				args[i] = strings.ReplaceAll(args[i], "%s", url)
+			}
+		} else {
+			args = append(args, url)
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("open", url)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Reaps the command, which would be left a zombie otherwise.
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			failed(err)
+		}
+	}()
+	return nil
+}
+
+// Returns a random hex string used to bind the callback to this login attempt.
+func randomNonce() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
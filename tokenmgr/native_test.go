@@ -0,0 +1,27 @@
+package tokenmgr
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestOpenBrowserReportsFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs the false command")
+	}
+
+	failed := make(chan error, 1)
+	if err := openBrowser("false", "https://example.com", func(err error) { failed <- err }); err != nil {
+		t.Fatalf("openBrowser error = %v", err)
+	}
+
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("failed called with a nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed not called after the browser command exited non-zero")
+	}
+}
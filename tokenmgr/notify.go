@@ -0,0 +1,34 @@
+package tokenmgr
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Shows a desktop notification telling the token was refreshed. Failures are
+// only logged, a missing notifier must not fail the run.
+func notifyLogin(newTTL time.Duration) {
+	title := "Vault login"
+	message := fmt.Sprintf("Token refreshed, ttl is now %v", newTTL)
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(message), strconv.Quote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	default:
+		cmd = exec.Command("notify-send", title, message)
+	}
+
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		slog.Warn("notifier not found, skipping desktop notification", "notifier", cmd.Args[0])
+	} else if err != nil {
+		slog.Warn("error sending desktop notification", "error", err)
+	}
+}
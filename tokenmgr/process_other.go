@@ -0,0 +1,19 @@
+//go:build !unix
+
+package tokenmgr
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Process groups are a unix thing, elsewhere cmd runs as usual.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Sends sig to cmd only.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(sig)
+}
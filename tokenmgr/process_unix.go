@@ -0,0 +1,19 @@
+//go:build unix
+
+package tokenmgr
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Runs cmd in its own process group, so that signalling the group also
+// reaches the processes it spawns, like the browser helper.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Sends sig to the process group of cmd, started with setProcessGroup.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,65 @@
+package tokenmgr
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Keeps renewing the current token in the background until ctx is done or
+// stop is called. The returned channel is closed once the token can't be
+// renewed any further, when a login is due. Renewals ask for
+// Config.RequestTTL when set.
+func (m *Manager) RenewInBackground(ctx context.Context) (done <-chan struct{}, stop func(), err error) {
+	info, err := m.Lookup(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Renewable {
+		return nil, nil, fmt.Errorf("token is not renewable")
+	}
+
+	watcher, err := m.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{
+		Secret: &api.Secret{Auth: &api.SecretAuth{
+			ClientToken:   m.client.Token(),
+			Renewable:     true,
+			LeaseDuration: int(info.TTL.Seconds()),
+		}},
+		Increment: int(m.cfg.RequestTTL.Seconds()),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating lifetime watcher: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	doneCh := make(chan struct{})
+	go watcher.Start()
+	go func() {
+		defer close(doneCh)
+		defer watcher.Stop()
+
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					slog.Warn("background renewal failed", "error", err)
+				} else {
+					slog.Info("token reached its maximum lifetime, background renewal stopped")
+				}
+				return
+			case renewal := <-watcher.RenewCh():
+				newTTL := time.Duration(renewal.Secret.Auth.LeaseDuration) * time.Second
+				tokenTTLSeconds.Set(newTTL.Seconds())
+				slog.Debug("renewed token in background", ttlAttr(newTTL))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	slog.Debug("renewing token in background", ttlAttr(info.TTL))
+	return doneCh, cancel, nil
+}
@@ -0,0 +1,46 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os/exec"
+	"time"
+)
+
+// Runs fn, retrying up to Config.MaxRetries times with exponential backoff
+// as long as it fails with a transient error.
+func (m *Manager) withRetry(ctx context.Context, fn func() error) error {
+	delay := m.cfg.RetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > m.cfg.MaxRetries || !isTransient(ctx, err) {
+			return err
+		}
+
+		slog.Warn("login failed, retrying", "attempt", attempt, "max_retries", m.cfg.MaxRetries, "delay", delay.String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Reports whether err is worth retrying: the vault CLI exiting non-zero or a
+// network error, but never a cancellation by the user nor a login timeout.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errLoginTimedOut) {
+		return false
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,50 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Revokes the stored token and removes it from the token file or the token
+// helper. Returns ErrNoToken when nothing is stored, VAULT_TOKEN is never
+// revoked.
+func (m *Manager) Revoke(ctx context.Context) error {
+	if m.cfg.TokenHelper == "" {
+		if _, err := os.Stat(m.cfg.TokenPath); os.IsNotExist(err) {
+			return ErrNoToken
+		}
+	}
+
+	token, err := m.storedToken(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading token: %v", err)
+	}
+	if token == "" {
+		return ErrNoToken
+	}
+	m.client.SetToken(token)
+
+	err = m.withFailover(ctx, func() error {
+		return m.client.Auth().Token().RevokeSelfWithContext(ctx, "")
+	})
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+		slog.Info("token is already expired or invalid", "token_path", m.cfg.TokenPath)
+	} else if err != nil {
+		return fmt.Errorf("error revoking token: %v", err)
+	}
+
+	if m.cfg.TokenHelper != "" {
+		return tokenHelperErase(ctx, m.cfg.TokenHelper)
+	}
+	if err := os.Remove(m.cfg.TokenPath); err != nil {
+		return fmt.Errorf("error removing token file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,446 @@
+package tokenmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const tokenTypeBatch = "batch"
+
+// Config.TokenPath reading the token from stdin.
+const StdinTokenPath = "-"
+
+// What we know about a token from its lookup or its login response.
+type TokenInfo struct {
+	TTL          time.Duration
+	CreationTTL  time.Duration
+	CreationTime time.Time
+	Renewable    bool
+	Type         string
+	Accessor     string
+	Policies     []string
+	Warnings     []string
+
+	// Time past which the token can't be renewed, zero if unknown.
+	MaxExpiry time.Time
+
+	// Whether the token never expires, like root tokens. TTL is 0 then.
+	NoExpiry bool
+
+	// Uses left before the token is revoked, 0 for unlimited.
+	NumUses int64
+}
+
+// Looks up the token the client is set up with.
+type tokenLooker func(ctx context.Context, client *api.Client) (*api.Secret, error)
+
+// Seam around the Vault API, swapped for a stub when testing ttl without a
+// Vault server.
+var lookupSelf tokenLooker = func(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	return client.Auth().Token().LookupSelfWithContext(ctx)
+}
+
+// Looks up the current token. The returned error wraps ErrNoToken when there
+// is no usable token, which always calls for a login, and ErrLookupFailed
+// when Vault couldn't tell, e.g. because it's unreachable.
+func (m *Manager) Lookup(ctx context.Context) (TokenInfo, error) {
+	tokenPath := m.cfg.TokenPath
+	token, err := m.storedToken(ctx)
+	if err != nil {
+		slog.Error("error reading token", "token_path", tokenPath, "error", err)
+		return TokenInfo{}, fmt.Errorf("%w: %v", ErrNoToken, err)
+	}
+	if token == "" {
+		return TokenInfo{}, ErrNoToken
+	}
+	if !plausibleToken(token) {
+		slog.Warn("stored token is corrupt, login needed", "token_path", tokenPath, "length", len(token))
+		return TokenInfo{}, fmt.Errorf("%w: corrupt token", ErrNoToken)
+	}
+	m.client.SetToken(token)
+
+	var secret *api.Secret
+	err = m.withFailover(ctx, func() (err error) {
+		secret, err = lookupSelf(ctx, m.client)
+		return err
+	})
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+		slog.Info("token is expired or invalid, login needed", "token_path", tokenPath)
+		return TokenInfo{}, fmt.Errorf("%w: %v", ErrNoToken, err)
+	} else if err != nil {
+		return TokenInfo{}, fmt.Errorf("%w: %w", ErrLookupFailed, err)
+	}
+	if secret == nil || secret.Data == nil {
+		// Vault answering e.g. 204 gives no secret and no error.
+		slog.Info("token lookup returned no data, login needed", "token_path", tokenPath)
+		return TokenInfo{}, fmt.Errorf("%w: empty token lookup response", ErrNoToken)
+	}
+
+	if m.cfg.DumpLookup != nil {
+		m.dumpLookup(secret.Data)
+	}
+
+	var info TokenInfo
+	info.Warnings = logWarnings(secret, "token lookup")
+
+	info.Renewable, err = secret.TokenIsRenewable()
+	if err != nil {
+		slog.Error("error reading renewable from token lookup data", "error", err)
+	}
+
+	info.Type, _ = secret.Data["type"].(string)
+	if info.Type == tokenTypeBatch {
+		// Batch tokens can't be renewed whatever the lookup says.
+		info.Renewable = false
+	}
+
+	info.Accessor, err = secret.TokenAccessor()
+	if err != nil {
+		slog.Error("error reading accessor from token lookup data", "error", err)
+	}
+
+	info.Policies, err = secret.TokenPolicies()
+	if err != nil {
+		slog.Error("error reading policies from token lookup data", "error", err)
+	}
+
+	// Only an explicit max TTL shows up in the lookup, the one of the role
+	// doesn't.
+	if creationTime, err := parseSeconds(secret.Data["creation_time"]); err != nil {
+		slog.Debug("no usable creation_time in token lookup data", "error", err)
+	} else {
+		info.CreationTime = time.Unix(int64(creationTime.Seconds()), 0)
+	}
+
+	explicitMaxTTL, err := parseSeconds(secret.Data["explicit_max_ttl"])
+	if err == nil && explicitMaxTTL > 0 && !info.CreationTime.IsZero() {
+		info.MaxExpiry = info.CreationTime.Add(explicitMaxTTL)
+	}
+
+	if numUses, ok := secret.Data["num_uses"].(json.Number); ok {
+		info.NumUses, _ = numUses.Int64()
+	}
+
+	if creationTTL, err := parseSeconds(secret.Data["creation_ttl"]); err != nil {
+		slog.Debug("no usable creation_ttl in token lookup data", "error", err)
+	} else {
+		info.CreationTTL = creationTTL
+	}
+
+	// Vault computes ttl with its own clock, so it's the fallback when
+	// expire_time is unusable and the reference to detect clock skew.
+	serverTTL, serverTTLErr := secret.TokenTTL()
+	if serverTTLErr == nil && secret.Data["ttl"] == nil {
+		// TokenTTL reports a missing ttl as 0.
+		serverTTLErr = fmt.Errorf("ttl not found")
+	}
+
+	expireTime, err := parseExpireTime(secret.Data["expire_time"])
+	// Tokens that never expire come with a zero expire_time, or none and a
+	// ttl of 0.
+	if (err == nil && expireTime.Unix() <= 0) || (err != nil && serverTTLErr == nil && serverTTL == 0 && !info.Renewable) {
+		slog.Info("token has no expiry", "token_path", tokenPath)
+		info.NoExpiry = true
+		return info, nil
+	}
+	if err != nil {
+		if serverTTLErr != nil {
+			slog.Error("no usable expire_time or ttl in token lookup data", "error", err, "ttl_error", serverTTLErr)
+			return info, nil
+		}
+		slog.Debug("no usable expire_time in token lookup data, using ttl", "error", err)
+		info.TTL = serverTTL
+		return info, nil
+	}
+
+	info.TTL = time.Until(expireTime)
+
+	// Trust the ttl computed by Vault over ours when they disagree too much.
+	if serverTTLErr != nil {
+		slog.Error("error reading ttl from token lookup data", "error", serverTTLErr)
+	} else if skew := info.TTL - serverTTL; skew > m.cfg.ClockSkewTolerance || -skew > m.cfg.ClockSkewTolerance {
+		slog.Warn("clock skew detected, using the ttl computed by vault", "local_ttl", info.TTL.String(), "server_ttl", serverTTL.String(), "skew", skew.String())
+		info.TTL = serverTTL
+	}
+
+	return info, nil
+}
+
+// Writes the lookup data to Config.DumpLookup, with the token id redacted.
+func (m *Manager) dumpLookup(data map[string]interface{}) {
+	redacted := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		redacted[k] = v
+	}
+	if _, ok := redacted["id"]; ok {
+		redacted["id"] = "[redacted]"
+	}
+
+	out, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		slog.Error("error encoding token lookup data", "error", err)
+		return
+	}
+	fmt.Fprintf(m.cfg.DumpLookup, "%s\n", out)
+}
+
+// Parses the expire_time of token lookup data.
+func parseExpireTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case nil:
+		return time.Time{}, fmt.Errorf("expire_time not found")
+	case string:
+		slog.Debug("read token expiry", "expire_time", t)
+		return time.Parse(time.RFC3339Nano, t)
+	default:
+		return time.Time{}, fmt.Errorf("expire_time is not a string")
+	}
+}
+
+// Returns the policies of required that the token doesn't have.
+func (i TokenInfo) missingPolicies(required []string) []string {
+	var missing []string
+	for _, p := range required {
+		if !slices.Contains(i.Policies, p) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// Returns the TokenInfo of the token issued by a login.
+func tokenInfoFromAuth(secret *api.Secret) (TokenInfo, error) {
+	if secret == nil || secret.Auth == nil {
+		return TokenInfo{}, fmt.Errorf("no auth info in login response")
+	}
+
+	newTTL, err := secret.TokenTTL()
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("error reading ttl of new token: %v", err)
+	}
+
+	// Login responses don't carry the token type, but batch tokens are
+	// recognizable by their prefix.
+	tokenType := "service"
+	if strings.HasPrefix(secret.Auth.ClientToken, "hvb.") || strings.HasPrefix(secret.Auth.ClientToken, "b.") {
+		tokenType = tokenTypeBatch
+	}
+
+	policies, err := secret.TokenPolicies()
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("error reading policies of new token: %v", err)
+	}
+
+	warnings := logWarnings(secret, "login")
+
+	return TokenInfo{
+		TTL:         newTTL,
+		CreationTTL: newTTL,
+		Renewable:   secret.Auth.Renewable && tokenType != tokenTypeBatch,
+		Type:        tokenType,
+		Accessor:    secret.Auth.Accessor,
+		Policies:    policies,
+		Warnings:    warnings,
+	}, nil
+}
+
+// Uses left at or below which a token is refreshed, since every lookup and
+// renewal uses it up a little more. Config.NumUses must be above it.
+const FewUses = 3
+
+// Reports whether the token is limited to a number of uses and almost used
+// up.
+func (info TokenInfo) fewUsesLeft() bool {
+	return info.NumUses > 0 && info.NumUses <= FewUses
+}
+
+// Logs and returns the warnings Vault returned with secret, e.g. about a
+// clamped TTL.
+func logWarnings(secret *api.Secret, request string) []string {
+	if secret == nil {
+		return nil
+	}
+	for _, w := range secret.Warnings {
+		slog.Warn("vault returned a warning", "request", request, "warning", w)
+	}
+	return secret.Warnings
+}
+
+// Returns the token stored through the token helper or in the token file,
+// or piped on stdin.
+func (m *Manager) storedToken(ctx context.Context) (string, error) {
+	if m.cfg.TokenHelper != "" {
+		return tokenHelperGet(ctx, m.cfg.TokenHelper)
+	}
+	if m.cfg.TokenPath == StdinTokenPath {
+		m.stdinOnce.Do(func() {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				m.stdinErr = fmt.Errorf("error reading token from stdin: %v", err)
+			}
+			if m.stdinErr == nil {
+				m.stdinToken, m.stdinErr = decodeToken(data, m.cfg.TokenFormat)
+			}
+		})
+		return m.stdinToken, m.stdinErr
+	}
+	return readToken(m.cfg.TokenPath, m.cfg.TokenFormat)
+}
+
+// Returns the token stored at tokenPath in format, falling back to
+// VAULT_TOKEN when the file doesn't exist. Returns "" if there is no token
+// at all.
+func readToken(tokenPath, format string) (string, error) {
+	if _, err := os.Stat(tokenPath); os.IsNotExist(err) {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			slog.Debug("token file not found, using VAULT_TOKEN", "token_path", tokenPath)
+			return token, nil
+		}
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error accessing token file: %v", err)
+	}
+
+	tokenData, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %v", err)
+	}
+
+	return decodeToken(tokenData, format)
+}
+
+// Reports whether token looks like a Vault token rather than the leftover
+// of a truncated write. Tokens are base62, base64url or UUIDs with a prefix
+// like hvs., so anything else is corrupt.
+func plausibleToken(token string) bool {
+	if len(token) > 4096 {
+		return false
+	}
+	switch token {
+	case "hvs.", "hvb.", "hvr.", "s.", "b.", "r.":
+		return false
+	}
+	for _, c := range token {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Seam around the Vault API, swapped for a stub when testing renewals
+// without a Vault server.
+var renewSelf = func(ctx context.Context, client *api.Client, increment int) (*api.Secret, error) {
+	return client.Auth().Token().RenewSelfWithContext(ctx, increment)
+}
+
+// Renews the current token for increment, returning its new TTL. An
+// increment of 0 lets Vault pick the default TTL of the token's role.
+func renew(ctx context.Context, client *api.Client, increment time.Duration) (time.Duration, error) {
+	secret, err := renewSelf(ctx, client, int(increment.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("error renewing token: %w", err)
+	}
+	logWarnings(secret, "renewal")
+
+	newTTL, err := secret.TokenTTL()
+	if err != nil {
+		return 0, fmt.Errorf("error reading ttl of renewed token: %v", err)
+	}
+
+	return newTTL, nil
+}
+
+// Stores token at path in format the way the vault CLI does, creating
+// missing parent directories with 0700 and the file with 0600.
+func writeToken(path, token, format string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating token directory: %v", err)
+	}
+
+	contents, err := encodeToken(token, format)
+	if err != nil {
+		return err
+	}
+	return writeTokenAtomic(path, contents)
+}
+
+// Replaces the file at path with one holding token, so that concurrent
+// readers see either the old or the new token but never part of one. The
+// file is created with 0600, whatever the permissions of the old one.
+func writeTokenAtomic(path, token string) error {
+	// Renaming over a symlink would replace it rather than its target.
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary token file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(token); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing token file: %v", err)
+	}
+	return nil
+}
+
+// Restricts the token file permissions to 0600 if they are any broader.
+func secureTokenFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error accessing token file: %v", err)
+	}
+
+	perm := info.Mode().Perm()
+	if perm&^0600 == 0 {
+		return nil
+	}
+
+	slog.Warn("warning: token file permissions are too broad, restricting to 0600", "token_path", path, "permissions", perm.String())
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("error restricting token file permissions: %v", err)
+	}
+
+	return nil
+}
+
+// Parses a number of seconds as returned in Vault response data.
+func parseSeconds(v interface{}) (time.Duration, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, fmt.Errorf("missing value")
+	case string:
+		return time.ParseDuration(n + "s")
+	default:
+		return time.ParseDuration(fmt.Sprintf("%vs", n))
+	}
+}
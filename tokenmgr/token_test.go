@@ -0,0 +1,186 @@
+package tokenmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// Replaces lookupSelf for the duration of the test.
+func stubLookup(t *testing.T, secret *api.Secret, err error) {
+	t.Helper()
+	orig := lookupSelf
+	lookupSelf = func(context.Context, *api.Client) (*api.Secret, error) {
+		return secret, err
+	}
+	t.Cleanup(func() { lookupSelf = orig })
+}
+
+// Returns a Manager on a token file in a temporary directory, holding token
+// unless it is empty. Nothing ever reaches a Vault server.
+func newTestManager(t *testing.T, token string, cfg Config) *Manager {
+	t.Helper()
+	t.Setenv("VAULT_TOKEN", "")
+
+	cfg.TokenPath = filepath.Join(t.TempDir(), "token")
+	if token != "" {
+		if err := os.WriteFile(cfg.TokenPath, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(client, cfg)
+}
+
+func TestLookupAndCheck(t *testing.T) {
+	expireIn := func(d time.Duration) string {
+		return time.Now().Add(d).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		data       map[string]interface{}
+		wantTTL    time.Duration
+		wantErr    error
+		wantAction Action
+	}{
+		{
+			name:       "ttl above min ttl",
+			token:      "hvs.abcdefghijklmnopqrstuvwx",
+			data:       map[string]interface{}{"ttl": json.Number("7200"), "expire_time": expireIn(2 * time.Hour)},
+			wantTTL:    2 * time.Hour,
+			wantAction: ActionSkipped,
+		},
+		{
+			name:       "ttl below min ttl",
+			token:      "hvs.abcdefghijklmnopqrstuvwx",
+			data:       map[string]interface{}{"ttl": json.Number("600"), "expire_time": expireIn(10 * time.Minute)},
+			wantTTL:    10 * time.Minute,
+			wantAction: ActionWouldLogin,
+		},
+		{
+			name:       "missing token file",
+			wantErr:    ErrNoToken,
+			wantAction: ActionWouldLogin,
+		},
+		{
+			name:       "malformed expire_time falls back to ttl",
+			token:      "hvs.abcdefghijklmnopqrstuvwx",
+			data:       map[string]interface{}{"ttl": json.Number("7200"), "expire_time": "tomorrow"},
+			wantTTL:    2 * time.Hour,
+			wantAction: ActionSkipped,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubLookup(t, &api.Secret{Data: tt.data}, nil)
+			m := newTestManager(t, tt.token, Config{
+				MinTTL:             time.Hour,
+				ClockSkewTolerance: time.Minute,
+				DryRun:             true,
+			})
+
+			info, err := m.Lookup(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Lookup error = %v, want %v", err, tt.wantErr)
+			}
+			if d := info.TTL - tt.wantTTL; d > time.Minute || d < -time.Minute {
+				t.Errorf("Lookup TTL = %v, want about %v", info.TTL, tt.wantTTL)
+			}
+
+			res, err := m.Check(context.Background())
+			if err != nil {
+				t.Fatalf("Check error = %v", err)
+			}
+			if res.Action != tt.wantAction {
+				t.Errorf("Check action = %q, want %q", res.Action, tt.wantAction)
+			}
+		})
+	}
+}
+
+// Vault may answer the lookup with neither a secret nor an error.
+func TestLookupEmptyResponse(t *testing.T) {
+	stubLookup(t, nil, nil)
+	m := newTestManager(t, "hvs.abcdefghijklmnopqrstuvwx", Config{MinTTL: time.Hour, DryRun: true})
+
+	if _, err := m.Lookup(context.Background()); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("Lookup error = %v, want %v", err, ErrNoToken)
+	}
+
+	res, err := m.Check(context.Background())
+	if err != nil {
+		t.Fatalf("Check error = %v", err)
+	}
+	if res.Action != ActionWouldLogin {
+		t.Errorf("Check action = %q, want %q", res.Action, ActionWouldLogin)
+	}
+}
+
+// A token revoked or expired between the lookup and the renewal gets a 403,
+// which must lead to a login rather than an error.
+func TestCheckLogsInWhenRenewalForbidden(t *testing.T) {
+	stubLookup(t, &api.Secret{Data: map[string]interface{}{
+		"ttl":       json.Number("600"),
+		"renewable": true,
+	}}, nil)
+
+	origRenewSelf := renewSelf
+	renewSelf = func(context.Context, *api.Client, int) (*api.Secret, error) {
+		return nil, &api.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}}
+	}
+	t.Cleanup(func() { renewSelf = origRenewSelf })
+
+	origLookPath, origRunLogin := lookPath, runLogin
+	var loggedIn bool
+	lookPath = func(string) (string, error) { return "vault", nil }
+	runLogin = func(*exec.Cmd, Config) error {
+		loggedIn = true
+		return errors.New("stub login")
+	}
+	t.Cleanup(func() { lookPath, runLogin = origLookPath, origRunLogin })
+
+	m := newTestManager(t, "hvs.abcdefghijklmnopqrstuvwx", Config{
+		MinTTL:     time.Hour,
+		BrowserCmd: "true",
+	})
+
+	_, err := m.Check(context.Background())
+	if !loggedIn {
+		t.Fatal("Check didn't login after the renewal was forbidden")
+	}
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("Check error = %v, want %v", err, ErrLoginFailed)
+	}
+}
+
+// The zero Config tolerates the drift between the clocks of any two
+// machines, and uses expire_time rather than the ttl Vault computed.
+func TestLookupZeroConfig(t *testing.T) {
+	stubLookup(t, &api.Secret{Data: map[string]interface{}{
+		"ttl":         json.Number("7190"),
+		"expire_time": time.Now().Add(2 * time.Hour).Format(time.RFC3339Nano),
+	}}, nil)
+	m := newTestManager(t, "hvs.abcdefghijklmnopqrstuvwx", Config{})
+
+	info, err := m.Lookup(context.Background())
+	if err != nil {
+		t.Fatalf("Lookup error = %v", err)
+	}
+	if info.TTL <= 7190*time.Second {
+		t.Errorf("Lookup TTL = %v, want the %v left until expire_time", info.TTL, 2*time.Hour)
+	}
+}
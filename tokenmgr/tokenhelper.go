@@ -0,0 +1,84 @@
+package tokenmgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+)
+
+// Subset of the vault CLI configuration file we care about.
+type vaultCLIConfig struct {
+	TokenHelper string `hcl:"token_helper"`
+}
+
+// Returns the token helper configured for the vault CLI in ~/.vault, or in
+// the file pointed to by VAULT_CONFIG_PATH.
+func TokenHelperPath() (string, error) {
+	configPath := os.Getenv("VAULT_CONFIG_PATH")
+	if configPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error finding home directory: %v", err)
+		}
+		configPath = filepath.Join(home, ".vault")
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading vault CLI config: %v", err)
+	}
+
+	var cfg vaultCLIConfig
+	if err := hcl.Decode(&cfg, string(data)); err != nil {
+		return "", fmt.Errorf("error parsing vault CLI config %s: %v", configPath, err)
+	}
+	if cfg.TokenHelper == "" {
+		return "", fmt.Errorf("no token_helper configured in %s", configPath)
+	}
+
+	return os.ExpandEnv(cfg.TokenHelper), nil
+}
+
+// Returns the token the helper currently stores, "" if there is none.
+func tokenHelperGet(ctx context.Context, helper string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, helper, "get")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running token helper get: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Hands token over to the helper for storage.
+func tokenHelperStore(ctx context.Context, helper, token string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, helper, "store")
+	cmd.Stdin = strings.NewReader(token)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running token helper store: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// Has the helper forget the token it stores.
+func tokenHelperErase(ctx context.Context, helper string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, helper, "erase")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running token helper erase: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package tokenmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Body POSTed to Config.WebhookURL after a login.
+type webhookEvent struct {
+	Event      string `json:"event"`
+	VaultAddr  string `json:"vault_addr"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	Timestamp  string `json:"timestamp"`
+}
+
+// Notifies the webhook of a successful login. Failures are only logged, the
+// login itself already succeeded.
+func (m *Manager) postLoginWebhook(ctx context.Context, newTTL time.Duration) {
+	event := webhookEvent{
+		Event:      "login",
+		VaultAddr:  m.client.Address(),
+		TTLSeconds: int64(newTTL.Seconds()),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := postWebhook(ctx, m.cfg.WebhookURL, m.cfg.WebhookTimeout, event); err != nil {
+		slog.Warn("error posting login event to webhook", "webhook_url", m.cfg.WebhookURL, "error", err)
+		return
+	}
+	slog.Debug("posted login event to webhook", "webhook_url", m.cfg.WebhookURL)
+}
+
+// POSTs payload as JSON to url, failing if it doesn't answer with a 2xx
+// within timeout.
+func postWebhook(ctx context.Context, url string, timeout time.Duration, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding webhook payload: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
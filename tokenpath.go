@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Variables available in --token-path templates.
+type tokenPathData struct {
+	// Host name of the Vault server, without the port.
+	Host    string
+	Profile string
+}
+
+// Expands the environment variables, a leading ~/ and the {{.Host}} and
+// {{.Profile}} template variables in path.
+func expandTokenPath(path, vaultAddr, profile string) (string, error) {
+	path = os.ExpandEnv(path)
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error expanding ~ in token path: %v", err)
+		}
+		path = filepath.Join(home, rest)
+	}
+
+	tmpl, err := template.New("token-path").Option("missingkey=error").Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("error parsing token path template: %v", err)
+	}
+
+	u, err := url.Parse(vaultAddr)
+	if err != nil {
+		return "", fmt.Errorf("error parsing vault address: %v", err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, tokenPathData{Host: u.Hostname(), Profile: profile}); err != nil {
+		return "", fmt.Errorf("error expanding token path template: %v", err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/giuscri/vault-periodic-oidc-login/tokenmgr"
+	"github.com/hashicorp/vault/api"
+)
+
+// Token of the tokens list of the config file, ready to be checked.
+type tokenRun struct {
+	vaultAddr string
+	tokenPath string
+	m         *tokenmgr.Manager
+}
+
+// Returns e with its empty keys set to those of defaults.
+func (e TokenEntry) withDefaults(defaults TokenEntry) TokenEntry {
+	if e.VaultAddr == "" {
+		e.VaultAddr = defaults.VaultAddr
+	}
+	if e.TokenPath == "" {
+		e.TokenPath = defaults.TokenPath
+	}
+	if e.Role == "" {
+		e.Role = defaults.Role
+	}
+	if e.MinTTL == "" {
+		e.MinTTL = defaults.MinTTL
+	}
+	if e.Namespace == "" {
+		e.Namespace = defaults.Namespace
+	}
+	return e
+}
+
+// Builds a Manager for each entry of the tokens list, sharing the settings of
+// base and the transport of client.
+func tokenRuns(entries []TokenEntry, client *api.Client, base tokenmgr.Config, profile string) ([]tokenRun, error) {
+	runs := make([]tokenRun, 0, len(entries))
+	seen := map[string]bool{}
+	for i, e := range entries {
+		if e.VaultAddr == "" || e.MinTTL == "" {
+			return nil, fmt.Errorf("tokens[%d] needs vaultAddr and minTTL, or their top-level keys", i)
+		}
+		var vaultAddrs stringsFlag
+		vaultAddrs.Set(e.VaultAddr)
+		for _, addr := range vaultAddrs {
+			if err := validateVaultAddr(addr); err != nil {
+				return nil, fmt.Errorf("tokens[%d]: invalid vaultAddr %q: %v", i, addr, err)
+			}
+		}
+
+		minTTL, minTTLPercent, err := parseMinTTL(e.MinTTL)
+		if err != nil {
+			return nil, fmt.Errorf("tokens[%d]: invalid minTTL %q: %v", i, e.MinTTL, err)
+		}
+
+		tokenPath, err := expandTokenPath(e.TokenPath, vaultAddrs[0], profile)
+		if err != nil {
+			return nil, fmt.Errorf("tokens[%d]: invalid tokenPath: %v", i, err)
+		}
+		if tokenPath == tokenmgr.StdinTokenPath {
+			return nil, fmt.Errorf("tokens[%d]: tokenPath can't be -", i)
+		}
+		if seen[tokenPath] {
+			return nil, fmt.Errorf("tokens[%d]: tokenPath %s is already used by another token", i, tokenPath)
+		}
+		seen[tokenPath] = true
+
+		c, err := client.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("error creating vault client: %v", err)
+		}
+		if err := c.SetAddress(vaultAddrs[0]); err != nil {
+			return nil, fmt.Errorf("tokens[%d]: invalid vaultAddr: %v", i, err)
+		}
+		if e.Namespace != "" {
+			c.SetNamespace(e.Namespace)
+		}
+
+		cfg := base
+		cfg.TokenPath = tokenPath
+		cfg.LockFile = tokenPath + ".lock"
+		cfg.Addresses = vaultAddrs
+		cfg.MinTTL = minTTL
+		cfg.MinTTLPercent = minTTLPercent
+		cfg.Role, cfg.FallbackRoles, err = splitRoles(e.Role)
+		if err != nil {
+			return nil, fmt.Errorf("tokens[%d]: invalid role %q: %v", i, e.Role, err)
+		}
+		cfg.Namespace = e.Namespace
+
+		runs = append(runs, tokenRun{
+			vaultAddr: vaultAddrs[0],
+			tokenPath: tokenPath,
+			m:         tokenmgr.New(c, cfg),
+		})
+	}
+	return runs, nil
+}
+
+// Exit codes from the best to the worst outcome of a token.
+var exitSeverity = []int{exitTokenValid, exitRefreshed, exitNeedsLogin, exitHookFailed, exitLoginFailed}
+
+// Returns the exit code of the worse outcome of a and b.
+func worseExit(a, b int) int {
+	if slices.Index(exitSeverity, b) > slices.Index(exitSeverity, a) {
+		return b
+	}
+	return a
+}
+
+// Checks every token in turn, going on after failures, then prints a summary
+// of the run. Returns the exit code of the worst outcome.
+func checkTokens(ctx context.Context, runs []tokenRun, opts options, healthCheck bool) int {
+	code := exitTokenValid
+	summary := make([]jsonReport, 0, len(runs))
+	for _, r := range runs {
+		slog.Debug("checking token", "token_path", r.tokenPath, "vault_addr", r.vaultAddr)
+
+		var res tokenmgr.Result
+		var err error
+		if healthCheck {
+			if err = r.m.CheckHealth(ctx); err != nil {
+				err = fmt.Errorf("vault server is not usable: %w", err)
+			}
+		}
+		if err == nil {
+			res, err = r.m.Check(ctx)
+		}
+		audit(opts, r.m.Address(), res, err)
+
+		switch {
+		case errors.Is(err, tokenmgr.ErrPostLoginHook):
+			slog.Error("error running post-login hook", "token_path", r.tokenPath, "vault_addr", r.vaultAddr, "error", err)
+			code = worseExit(code, exitHookFailed)
+		case err != nil:
+			slog.Error("error doing vault login", append([]any{"token_path", r.tokenPath, "vault_addr", r.vaultAddr, "action", actionLoginFailed, "error", err}, hintArgs(err)...)...)
+			code = worseExit(code, exitLoginFailed)
+		case res.Action == tokenmgr.ActionWouldLogin:
+			code = worseExit(code, exitNeedsLogin)
+		case res.Action != tokenmgr.ActionSkipped:
+			code = worseExit(code, exitRefreshed)
+		}
+
+		tokenReport := newJSONReport(res, err)
+		tokenReport.TokenPath = r.tokenPath
+		tokenReport.VaultAddr = r.vaultAddr
+		summary = append(summary, tokenReport)
+	}
+
+	if opts.output == outputJSON {
+		for _, r := range summary {
+			printJSON(r)
+		}
+		return code
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN PATH\tVAULT ADDR\tACTION\tTTL")
+	for _, r := range summary {
+		outcome := string(r.Action) + "\t" + formatTTL(time.Duration(r.TTLSeconds)*time.Second, opts.ttlUnit)
+		if r.Error != nil {
+			action := actionLoginFailed
+			if r.Action != "" {
+				// The login worked but the post-login hook failed.
+				action = string(r.Action)
+			}
+			outcome = action + "\t" + *r.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.TokenPath, r.VaultAddr, outcome)
+	}
+	w.Flush()
+	return code
+}